@@ -1,35 +1,47 @@
+// Benchmark compares the CPU time and memory use of LilyPond versions.
+// Run it from a LilyPond git checkout; each version is built in its
+// own worktree under --worktrees, leaving the checkout alone.
+//
+// Compare a version against a baseline, or rank several against one:
+//
+//	benchmark --version=HEAD --baseline=HEAD^ --run_count=10 input.ly
+//	benchmark --baseline=master --versions=opt1,opt2,opt3 input.ly
+//
+// Report the trend over a commit range, or find the commit that made
+// an input slower:
+//
+//	benchmark --range=v2.23.0..master --every=10 input.ly
+//	benchmark --bisect --good=v2.23.0 --bad=master --threshold=5% input.ly
+//
+// With --suite, several inputs are benchmarked in turn. The reports go
+// to --out, next to .json and .csv files with the raw samples, and all
+// samples are added to the history in --history.
 package main
 
 import (
-	"bytes"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
-	"sort"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var startBranch string
-
 func getCommit(version string) (string, error) {
 	cmd := exec.Command("git", "rev-parse", "--short", version)
 	out, err := cmd.Output()
 	return strings.TrimSpace(string(out)), err
 }
 
-func checkout(version string) error {
-	cmd := exec.Command("git", "checkout", version)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+func gitOutput(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	return strings.TrimSpace(string(out)), err
 }
 
 func describe(v string) string {
@@ -39,20 +51,6 @@ func describe(v string) string {
 	return strings.TrimSpace(string(out))
 }
 
-func workdirDiff() (string, error) {
-	cmd := exec.Command("git", "diff")
-	out, err := cmd.Output()
-	return strings.TrimSpace(string(out)), err
-}
-
-func getBranch() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "--symbolic-full-name", "HEAD")
-	out, err := cmd.Output()
-	branch := strings.TrimSpace(string(out))
-	branch = strings.TrimPrefix(branch, "refs/heads/")
-	return branch, err
-}
-
 func getCPUType() (string, error) {
 	content, err := ioutil.ReadFile("/proc/cpuinfo")
 	if err != nil {
@@ -106,10 +104,7 @@ func setCPUSpeed(minKhz, maxKhz int) error {
 
 func Error(msg string) {
 	fmt.Println(msg)
-	if startBranch != "" {
-		fmt.Println("back to branch", startBranch)
-		checkout(startBranch)
-	}
+	removeWorktrees()
 	os.Exit(1)
 }
 
@@ -119,19 +114,6 @@ func check(err error) {
 	}
 }
 
-func sanityCheck() {
-	diff, err := workdirDiff()
-	check(err)
-	if diff != "" {
-		Error("should be clean")
-	}
-	content, err := ioutil.ReadFile("config.make")
-	check(err)
-	if !bytes.Contains(content, []byte("-O2")) {
-		Error("need -O2 for benchmarking")
-	}
-}
-
 func Shell(shcmd string) error {
 	cmd := exec.Command("/bin/sh", "-c", shcmd)
 	cmd.Stdout = os.Stdout
@@ -139,100 +121,61 @@ func Shell(shcmd string) error {
 	return cmd.Run()
 }
 
-func buildVersion(v string) error {
-	if err := checkout(v); err != nil {
-		return err
-	}
-	if content, err := ioutil.ReadFile("config.make"); err != nil {
-		return err
-	} else if !strings.Contains(string(content), "-O2") {
-		return fmt.Errorf("config.mark is missing -O2")
-	}
-	bin := fmt.Sprintf("binaries/lilypond.%s", v)
-	callBin := fmt.Sprintf("out/bin/lilypond.%s", v)
-	if _, err := os.Lstat(bin); err != nil {
-		if err := Shell(fmt.Sprintf("make -C flower/ clean && make -C lily/ clean && make -C flower -j4 && make -C lily/ -j4 && cp lily/out/lilypond %s", bin)); err != nil {
-			return err
-		}
-	}
-	os.Remove(callBin)
-	if err := os.Link(bin, callBin); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-type runResults struct {
-	mem  float64
-	time float64
-}
-
 type allResults struct {
-	baseMem  []float64
-	versMem  []float64
-	baseTime []float64
-	versTime []float64
+	base     *samples
+	vers     *samples
 	runCount int
 	args     []string
 }
 
-var (
-	timeRe = regexp.MustCompile(`User time \(seconds\): ([0-9.]+)`)
-	memRe  = regexp.MustCompile(`Maximum resident set size.*: ([0-9.]+)`)
-)
-
 func commandId(args []string) string {
 	return regexp.MustCompile("[^a-zA-Z0-9-_]").ReplaceAllString(time.Now().Format(time.RFC3339)+strings.Join(args, ""), "")
 }
 
-func benchmark(v1, v2 string, count int, outDir string, args []string) allResults {
-	mem := map[string][]float64{}
-	time := map[string][]float64{}
+// measure runs each version count times with args, interleaving the
+// versions in a random order per round, and returns the samples per
+// version. The warmup runs are discarded. Each round waits for the
+// machine to be quiet.
+func measure(versions []string, count int, outDir string, args []string) map[string]*samples {
+	result := map[string]*samples{}
+	for _, v := range versions {
+		result[v] = &samples{}
+	}
 
+	for i := range *warmup {
+		check(waitQuiet())
+		for _, j := range order.Perm(len(versions)) {
+			v := versions[j]
+			out := fmt.Sprintf("%s/%s-%s.warmup%d.txt", outDir, commandId(args), v, i)
+			log.Println("warming up", lilypondBin(v), args)
+			_, err := runLilypond(lilypondBin(v), args, out)
+			check(err)
+		}
+	}
 	for i := range count {
-		for _, v := range []string{v1, v2} {
+		check(waitQuiet())
+		for _, j := range order.Perm(len(versions)) {
+			v := versions[j]
 			out := fmt.Sprintf("%s/%s-%s.%d.txt", outDir, commandId(args), v, i)
-
-			check(checkout(v))
-			cmd := fmt.Sprintf("/usr/bin/time -v out/bin/lilypond.%s %s >& %s", v, strings.Join(args, " "), out)
-			log.Println("running", cmd)
-			check(Shell(cmd))
-
-			content, err := ioutil.ReadFile(out)
-			check(err)
-			cstr := string(content)
-			match := timeRe.FindStringSubmatch(cstr)
-			t, err := strconv.ParseFloat(match[1], 64)
+			log.Println("running", lilypondBin(v), args)
+			st, err := runLilypond(lilypondBin(v), args, out)
 			check(err)
-			match = memRe.FindStringSubmatch(cstr)
-			m, err := strconv.ParseFloat(match[1], 64)
-			check(err)
-
-			mem[v] = append(mem[v], m)
-			time[v] = append(time[v], t)
+			result[v].add(st)
 		}
 	}
+	return result
+}
 
+func benchmark(v1, v2 string, count int, outDir string, args []string) allResults {
+	s := measure([]string{v1, v2}, count, outDir, args)
 	return allResults{
-		baseMem:  mem[v1],
-		baseTime: time[v1],
-		versMem:  mem[v2],
-		versTime: time[v2],
+		base:     s[v1],
+		vers:     s[v2],
 		args:     args,
 		runCount: count,
 	}
 }
 
-func stddev(fs []float64) float64 {
-	a := mean(fs)
-	tot := 0.0
-	for _, f := range fs {
-		tot += (f - a) * (f - a)
-	}
-	return math.Sqrt(tot / float64(len(fs)-1))
-}
-
 func mean(fs []float64) float64 {
 	tot := 0.0
 	for _, f := range fs {
@@ -241,79 +184,74 @@ func mean(fs []float64) float64 {
 	return tot / float64(len(fs))
 }
 
-func analyzeData(base []float64, data []float64, name string, version string) string {
-	sort.Float64s(base)
-	sort.Float64s(data)
-
-	baseMed := base[len(base)/2]
-	versMed := data[len(data)/2]
-
-	delta := versMed - baseMed
-	baseStddev := stddev(base)
-	dataStddev := stddev(data)
-
-	qual := "neutral"
-	if math.Abs(delta) > baseStddev+dataStddev {
-		if name == "mem" {
-			if delta > 0 {
-				qual = "fatter"
-			} else {
-				qual = "leaner"
-			}
-		}
-		if name == "time" {
-			if delta > 0 {
-				qual = "slower"
-			} else {
-				qual = "faster"
-			}
-		}
-	}
+var (
+	confidence         = flag.Float64("confidence", 0.95, "confidence level for intervals and significance")
+	tolerance          = flag.Float64("tolerance", 0.01, "relative difference below which an insignificant result is neutral")
+	bootstrapResamples = flag.Int("bootstrap", 10000, "number of bootstrap resamples")
+	historyDir         = flag.String("history", "benchmark-history", "directory of the sample history")
+)
 
-	return fmt.Sprintf(`    %s delta: %f (stddev %f %f n=%d)
-    %s delta: %f %% (%s is %s)`, name, delta, baseStddev, dataStddev, len(base), name, 100.0*delta/baseMed, version, qual)
+func analyzeData(base []float64, data []float64, name string) *comparison {
+	return compareSamples(name, base, data, *confidence, *tolerance)
 }
 
-func analyze(base, vers string, res allResults) string {
+// environment describes the CPU the benchmark runs on.
+func environment() string {
 	speeds, _ := getCPUSpeedsKhz()
 	cpu, _ := getCPUType()
 	if strings.Contains(cpu, "@") {
 		fs := strings.SplitN(cpu, "@", 2)
 		cpu = fs[0]
 	}
+	return fmt.Sprintf("%s at %d Mhz\n%s\n", cpu, speeds["scaling_min_freq"]/1000, noise)
+}
 
+func analyze(base, vers string, res allResults) string {
 	r := fmt.Sprintf(`benchmark for arguments: %s
 
-%s at %d Mhz
-
+%s
 raw data (%s):
    %v %v
 raw data (%s):
    %v %v
 `, res.args,
-		cpu, speeds["scaling_min_freq"]/1000,
-		base, res.baseMem, res.baseTime,
-		vers, res.versMem, res.versTime)
+		environment(),
+		base, res.base.Mem, res.base.Time,
+		vers, res.vers.Mem, res.vers.Time)
 
 	r += fmt.Sprintf(`%s - %s
     baseline %s - %s
     args %s
-%s
-%s
-`, vers, describe(vers), base, describe(base), res.args,
-		analyzeData(res.baseMem, res.versMem, "mem", vers),
-		analyzeData(res.baseTime, res.versTime, "time", vers))
+    n=%d
+`, vers, describe(vers), base, describe(base), res.args, res.runCount)
+	for _, c := range res.vers.comparisons(res.base) {
+		r += c.String() + "\n"
+	}
+	r += phaseReport(phaseComparisons(res.base, res.vers))
 
 	return r
 }
 
 func main() {
 	version := flag.String("version", "HEAD", "version to test")
+	versions := flag.String("versions", "", "comma separated versions to compare against --baseline and rank, instead of --version")
 	baseline := flag.String("baseline", "", "baseline")
 	runCount := flag.Int("run_count", 3, "run count")
 	outDir := flag.String("out", "benchmark-results", "out dir")
+	suite := flag.String("suite", "", "comma separated globs of inputs to benchmark one by one; the arguments are passed as options")
+	suiteFile := flag.String("suite_file", "", "file listing globs of inputs for --suite, one per line")
+	commitRange := flag.String("range", "", "benchmark the commits of this git range (e.g. v2.22.0..master) and report the trend")
+	every := flag.Int("every", 1, "with --range, benchmark every Nth commit")
+	trendOnly := flag.Bool("trend", false, "with --range, only report the trend from the history")
+	doBisect := flag.Bool("bisect", false, "find the first commit between --good and --bad that is slower by --threshold")
+	good := flag.String("good", "", "with --bisect, a commit with good performance")
+	bad := flag.String("bad", "", "with --bisect, a slow commit")
+	threshold := flag.String("threshold", "5%", "with --bisect, the slowdown to look for")
+	maxRuns := flag.Int("max_runs", 30, "with --bisect, the maximum runs per commit to reach a clear verdict")
 
 	flag.Parse()
+	defer removeWorktrees()
+	check(setupNoise())
 	speeds, err := getCPUSpeedsKhz()
 	check(err)
 
@@ -325,6 +263,114 @@ func main() {
 	} else {
 		log.Printf("CPU freq %d Mhz", min/1000)
 	}
+	argLists := [][]string{flag.Args()}
+	if *suite != "" || *suiteFile != "" {
+		inputs, err := suiteInputs(*suite, *suiteFile)
+		check(err)
+		argLists = nil
+		for _, in := range inputs {
+			argLists = append(argLists, append(append([]string(nil), flag.Args()...), in))
+		}
+	}
+
+	if *doBisect {
+		if *good == "" || *bad == "" {
+			Error("--bisect needs --good and --bad")
+		}
+		if len(argLists) != 1 {
+			Error("--bisect takes a single input")
+		}
+		t, err := parseThreshold(*threshold)
+		check(err)
+		goodCommit, err := getCommit(*good)
+		check(err)
+		b := &bisector{
+			good:      goodCommit,
+			threshold: t,
+			runCount:  *runCount,
+			maxRuns:   *maxRuns,
+			outDir:    *outDir,
+			args:      argLists[0],
+			samples:   map[string]*samples{},
+		}
+		first, err := b.bisect(*bad)
+		check(err)
+		report := fmt.Sprintf("first commit %g%% slower than %s:\n%s - %s\n", 100*t, goodCommit, first, describe(first))
+		log.Print(report)
+		fn := filepath.Join(*outDir, fmt.Sprintf("%s-bisect", commandId(flag.Args())))
+		check(ioutil.WriteFile(fn, []byte(report), 0644))
+		return
+	}
+
+	if *commitRange != "" {
+		commits, err := rangeCommits(*commitRange, *every)
+		check(err)
+		if !*trendOnly {
+			for _, c := range commits {
+				check(buildVersion(c))
+			}
+			for _, args := range argLists {
+				check(appendHistory(*historyDir, args, measure(commits, *runCount, *outDir, args)))
+			}
+		}
+		env := getEnvInfo()
+		history, err := readHistory(*historyDir, env.Hostname)
+		check(err)
+		report := trendReport(commits, argLists, history)
+		log.Println(report)
+		fn := filepath.Join(*outDir, fmt.Sprintf("%s-trend", commandId(flag.Args())))
+		check(ioutil.WriteFile(fn, []byte(report), 0644))
+		return
+	}
+
+	if *versions != "" {
+		if *baseline == "" {
+			Error("--versions needs --baseline")
+		}
+		base, err := getCommit(*baseline)
+		check(err)
+		var vs []string
+		for v := range strings.SplitSeq(*versions, ",") {
+			c, err := getCommit(strings.TrimSpace(v))
+			check(err)
+			if c != base && !slices.Contains(vs, c) {
+				vs = append(vs, c)
+			}
+		}
+		if len(vs) == 0 {
+			Error("--versions has no versions besides the baseline")
+		}
+		all := append([]string{base}, vs...)
+		for _, v := range all {
+			check(buildVersion(v))
+		}
+
+		byVersion := map[string][]allResults{}
+		for _, args := range argLists {
+			s := measure(all, *runCount, *outDir, args)
+			check(appendHistory(*historyDir, args, s))
+			for _, v := range vs {
+				byVersion[v] = append(byVersion[v], allResults{
+					base:     s[base],
+					vers:     s[v],
+					runCount: *runCount,
+					args:     args,
+				})
+			}
+		}
+		m := newMatrix(base, vs, byVersion)
+		report := m.report(byVersion)
+		log.Println(report)
+		fn := filepath.Join(*outDir, fmt.Sprintf("%s-matrix-base%s", commandId(flag.Args()), base))
+		check(ioutil.WriteFile(fn, []byte(report), 0644))
+		check(m.writeJSON(fn + ".json"))
+		for _, r := range m.Records {
+			check(r.writeCSVFile(fmt.Sprintf("%s-v%s.csv", fn, r.Version.Commit)))
+		}
+		log.Printf("results in %s{,.json,-v*.csv}", fn)
+		return
+	}
+
 	if *baseline == "" {
 		*baseline, err = getCommit(*version + "^")
 		check(err)
@@ -333,22 +379,32 @@ func main() {
 	check(err)
 	*version, err = getCommit(*version)
 	check(err)
-	startBranch, err = getBranch()
-	check(err)
-	log.Println("startbranch is", startBranch)
-	sanityCheck()
-
 	for _, v := range []string{*baseline, *version} {
 		check(buildVersion(v))
 	}
 
-	result := benchmark(*baseline, *version, *runCount, *outDir, flag.Args())
-	log.Println(result)
-	summary := analyze(*baseline, *version, result)
-	log.Println(summary)
-	check(ioutil.WriteFile(filepath.Join(*outDir, fmt.Sprintf("%s-v%s-base%s", commandId(flag.Args()),
-		*version, *baseline)), []byte(summary), 0644))
-	if startBranch != "" {
-		checkout(startBranch)
+	var results []allResults
+	for _, args := range argLists {
+		result := benchmark(*baseline, *version, *runCount, *outDir, args)
+		log.Println(result)
+		results = append(results, result)
+		check(appendHistory(*historyDir, args, map[string]*samples{
+			*baseline: result.base,
+			*version:  result.vers,
+		}))
 	}
+	var summary string
+	if len(results) > 1 {
+		summary = analyzeSuite(*baseline, *version, results)
+	} else {
+		summary = analyze(*baseline, *version, results[0])
+	}
+	log.Println(summary)
+	base := filepath.Join(*outDir, fmt.Sprintf("%s-v%s-base%s", commandId(flag.Args()),
+		*version, *baseline))
+	check(ioutil.WriteFile(base, []byte(summary), 0644))
+	record := newRecord(*baseline, *version, results)
+	check(record.writeJSON(base + ".json"))
+	check(record.writeCSVFile(base + ".csv"))
+	log.Printf("results in %s{,.json,.csv}", base)
 }
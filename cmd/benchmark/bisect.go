@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// parseThreshold parses a relative threshold, either as a percentage
+// ("5%") or as a fraction ("0.05").
+func parseThreshold(s string) (float64, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		f, err := strconv.ParseFloat(p, 64)
+		return f / 100, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// bisector finds the first commit that is slower than good by a
+// threshold, measuring each candidate against good until the
+// comparison is clear.
+type bisector struct {
+	good      string
+	threshold float64
+	runCount  int
+	maxRuns   int
+	outDir    string
+	args      []string
+
+	// samples accumulates the samples per commit, so good and
+	// revisited commits keep their earlier runs.
+	samples map[string]*samples
+}
+
+// isSlow classifies a comparison against good. A commit is slow if the
+// confidence interval of its time ratio lies above 1+threshold, and
+// fine if it lies below. Otherwise, clear is false.
+func isSlow(c *comparison, threshold float64) (slow, clear bool) {
+	limit := 1 + threshold
+	switch {
+	case c.P < 1-c.Confidence && c.MedianCI[0] > limit:
+		return true, true
+	case c.MedianCI[1] < limit:
+		return false, true
+	}
+	return c.MedianRatio > limit, false
+}
+
+// measure runs commit and good n times more.
+func (b *bisector) measure(commit string, n int) {
+	res := measure([]string{b.good, commit}, n, b.outDir, b.args)
+	for _, c := range []string{b.good, commit} {
+		s := b.samples[c]
+		if s == nil {
+			s = &samples{}
+			b.samples[c] = s
+		}
+		s.merge(res[c])
+	}
+	if err := appendHistory(*historyDir, b.args, res); err != nil {
+		log.Printf("appendHistory: %v", err)
+	}
+}
+
+// slow reports whether commit is slower than good, adding runs until
+// the comparison is clear or maxRuns is reached.
+func (b *bisector) slow(commit string) bool {
+	check(buildVersion(commit))
+	n := b.runCount
+	for {
+		have := 0
+		if s := b.samples[commit]; s != nil {
+			have = len(s.Time)
+		}
+		if have < n {
+			b.measure(commit, n-have)
+		}
+		c := analyzeData(b.samples[b.good].Time, b.samples[commit].Time, "time")
+		slow, clear := isSlow(c, b.threshold)
+		log.Printf("bisect: %s is %+.2f %% (CI %+.2f %% .. %+.2f %%, n=%d): slow=%v clear=%v",
+			commit, 100*(c.MedianRatio-1), 100*(c.MedianCI[0]-1), 100*(c.MedianCI[1]-1), len(b.samples[commit].Time), slow, clear)
+		if clear {
+			return slow
+		}
+		if n >= b.maxRuns {
+			log.Printf("bisect: %s still unclear after %d runs; going by the median", commit, n)
+			return slow
+		}
+		n = min(2*n, b.maxRuns)
+	}
+}
+
+// bisect returns the first commit of the first-parent history from good
+// to bad that is slower than good.
+func (b *bisector) bisect(bad string) (string, error) {
+	out, err := gitOutput("rev-list", "--first-parent", "--reverse", "--abbrev-commit", b.good+".."+bad)
+	if err != nil {
+		return "", err
+	}
+	commits := strings.Fields(out)
+	if len(commits) == 0 {
+		return "", fmt.Errorf("no commits between %s and %s", b.good, bad)
+	}
+	check(buildVersion(b.good))
+	if !b.slow(commits[len(commits)-1]) {
+		return "", fmt.Errorf("%s is not %g%% slower than %s", bad, 100*b.threshold, b.good)
+	}
+
+	// commits[hi] is slow; everything before lo is fine.
+	lo, hi := 0, len(commits)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		log.Printf("bisect: %d commits left, trying %s", hi-lo+1, commits[mid])
+		if b.slow(commits[mid]) {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return commits[hi], nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestParseThreshold(t *testing.T) {
+	for in, want := range map[string]float64{"5%": 0.05, "0.1": 0.1, "12.5%": 0.125} {
+		if got, err := parseThreshold(in); err != nil || got != want {
+			t.Errorf("%q: got %v, %v, want %v", in, got, err, want)
+		}
+	}
+	if _, err := parseThreshold("fast"); err == nil {
+		t.Error("want error")
+	}
+}
+
+func TestIsSlow(t *testing.T) {
+	for _, tc := range []struct {
+		c           comparison
+		slow, clear bool
+	}{
+		{comparison{MedianRatio: 1.08, MedianCI: [2]float64{1.06, 1.10}, P: 0.001, Confidence: 0.95}, true, true},
+		{comparison{MedianRatio: 1.0, MedianCI: [2]float64{0.99, 1.01}, P: 0.8, Confidence: 0.95}, false, true},
+		{comparison{MedianRatio: 1.04, MedianCI: [2]float64{0.98, 1.10}, P: 0.2, Confidence: 0.95}, false, false},
+		{comparison{MedianRatio: 1.07, MedianCI: [2]float64{1.02, 1.12}, P: 0.01, Confidence: 0.95}, true, false},
+		// Significant, but below the threshold.
+		{comparison{MedianRatio: 1.01, MedianCI: [2]float64{1.005, 1.015}, P: 0.001, Confidence: 0.95}, false, true},
+		{comparison{MedianRatio: 1.04, MedianCI: [2]float64{1.03, 1.045}, P: 0.001, Confidence: 0.95}, false, true},
+	} {
+		slow, clear := isSlow(&tc.c, 0.05)
+		if slow != tc.slow || clear != tc.clear {
+			t.Errorf("%+v: got slow=%v clear=%v", tc.c, slow, clear)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The history is a file of JSON lines in the history directory, one
+// line per benchmarked commit and input, collected over all runs.
+const historyFile = "samples.jsonl"
+
+// historyEntry holds the samples of one commit for one argument list.
+type historyEntry struct {
+	Commit   string    `json:"commit"`
+	Input    string    `json:"input"`
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	CPU      string    `json:"cpu"`
+	Samples  samples   `json:"samples"`
+}
+
+// appendHistory adds the samples per commit for args to the history
+// in dir.
+func appendHistory(dir string, args []string, byCommit map[string]*samples) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, historyFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	env := getEnvInfo()
+	enc := json.NewEncoder(f)
+	for commit, s := range byCommit {
+		if err := enc.Encode(&historyEntry{
+			Commit:   commit,
+			Input:    strings.Join(args, " "),
+			Time:     time.Now(),
+			Hostname: env.Hostname,
+			CPU:      env.CPU,
+			Samples:  s.withoutProfiles(),
+		}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readHistory returns the samples in the history in dir by input and
+// commit. Samples of several runs are merged, if they were taken on
+// the same host.
+func readHistory(dir, hostname string) (map[string]map[string]*samples, error) {
+	f, err := os.Open(filepath.Join(dir, historyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	result := map[string]map[string]*samples{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var e historyEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s: %v", historyFile, err)
+		}
+		if e.Hostname != hostname {
+			continue
+		}
+		if result[e.Input] == nil {
+			result[e.Input] = map[string]*samples{}
+		}
+		s := result[e.Input][e.Commit]
+		if s == nil {
+			s = &samples{}
+			result[e.Input][e.Commit] = s
+		}
+		s.merge(&e.Samples)
+	}
+	return result, scanner.Err()
+}
+
+// rangeCommits returns every nth first-parent commit of the git
+// revision range, oldest first. The newest commit is always included.
+func rangeCommits(rng string, every int) ([]string, error) {
+	out, err := gitOutput("rev-list", "--first-parent", "--reverse", "--abbrev-commit", rng)
+	if err != nil {
+		return nil, err
+	}
+	all := strings.Fields(out)
+	return everyNth(all, every), nil
+}
+
+// everyNth returns every nth element of all, counting back from the
+// last one, oldest first.
+func everyNth(all []string, n int) []string {
+	var picked []string
+	for i := len(all) - 1; i >= 0; i -= max(n, 1) {
+		picked = append([]string{all[i]}, picked...)
+	}
+	return picked
+}
+
+// trendStep is the change between consecutive benchmarked commits.
+type trendStep struct {
+	Commit string
+	Time   *comparison
+	Mem    *comparison
+}
+
+// trend compares the samples of each commit with those of the previous
+// commit that has samples.
+func trend(commits []string, byCommit map[string]*samples) []trendStep {
+	var steps []trendStep
+	var prev *samples
+	for _, c := range commits {
+		s := byCommit[c]
+		if s == nil || len(s.Time) == 0 {
+			continue
+		}
+		step := trendStep{Commit: c}
+		if prev != nil {
+			step.Time = analyzeData(prev.Time, s.Time, "time")
+			step.Mem = analyzeData(prev.Mem, s.Mem, "mem")
+		}
+		steps = append(steps, step)
+		prev = s
+	}
+	return steps
+}
+
+// significant reports whether c found a difference.
+func (c *comparison) significant() bool {
+	return c != nil && c.conclusive() && c.Verdict != "neutral"
+}
+
+// trendReport shows the medians per commit for each input, marking
+// the commits where time or memory stepped significantly.
+func trendReport(commits []string, argLists [][]string, history map[string]map[string]*samples) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "trend over %d commits\n\n%s\n", len(commits), environment())
+	for _, args := range argLists {
+		input := strings.Join(args, " ")
+		fmt.Fprintf(&sb, "input: %s\n", input)
+		tw := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "COMMIT\tN\tTIME\tDELTA\tMEM\tDELTA\tSTEP\tSUBJECT")
+		for _, st := range trend(commits, history[input]) {
+			s := history[input][st.Commit]
+			tdelta, mdelta, step := "", "", ""
+			if st.Time != nil {
+				tdelta = fmt.Sprintf("%+.2f %%", 100*(st.Time.MedianRatio-1))
+				mdelta = fmt.Sprintf("%+.2f %%", 100*(st.Mem.MedianRatio-1))
+			}
+			for _, c := range []*comparison{st.Time, st.Mem} {
+				if c.significant() {
+					step += "<<< " + c.Verdict + " "
+				}
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%.3f\t%s\t%.0f\t%s\t%s\t%s\n", st.Commit, len(s.Time),
+				median(s.Time), tdelta, median(s.Mem), mdelta, step, describe(st.Commit))
+		}
+		tw.Flush()
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEveryNth(t *testing.T) {
+	all := []string{"a", "b", "c", "d", "e", "f", "g"}
+	if got, want := everyNth(all, 3), []string{"a", "d", "g"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("every 3: got %v, want %v", got, want)
+	}
+	if got, want := everyNth(all, 4), []string{"c", "g"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("every 4: got %v, want %v", got, want)
+	}
+	if got := everyNth(all, 0); !reflect.DeepEqual(got, all) {
+		t.Errorf("every 0: got %v", got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	args := []string{"-dbackend=null", "a.ly"}
+	for range 2 {
+		if err := appendHistory(dir, args, map[string]*samples{
+			"abc": {Time: []float64{1}, Mem: []float64{10}},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	host, _ := os.Hostname()
+	h, err := readHistory(dir, host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &samples{Time: []float64{1, 1}, Mem: []float64{10, 10}}
+	if got := h["-dbackend=null a.ly"]["abc"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if h, err := readHistory(dir, "elsewhere"); err != nil || len(h) != 0 {
+		t.Errorf("other host: got %v, %v", h, err)
+	}
+}
+
+func TestTrend(t *testing.T) {
+	flat := func(v float64) *samples {
+		s := &samples{}
+		for i := range 10 {
+			s.Time = append(s.Time, v+float64(i)*0.001)
+			s.Mem = append(s.Mem, 1000+float64(i))
+		}
+		return s
+	}
+	byCommit := map[string]*samples{
+		"c1": flat(10),
+		"c2": flat(10),
+		"c4": flat(11),
+	}
+	steps := trend([]string{"c1", "c2", "c3", "c4"}, byCommit)
+	if len(steps) != 3 {
+		t.Fatalf("got %d steps, want 3", len(steps))
+	}
+	if steps[0].Time != nil {
+		t.Errorf("first commit has a comparison")
+	}
+	if steps[1].Time.significant() {
+		t.Errorf("c2: got %q", steps[1].Time.Verdict)
+	}
+	if s := steps[2]; s.Commit != "c4" || s.Time.Verdict != "slower" || s.Mem.significant() {
+		t.Errorf("c4: got %s time %q mem %q", s.Commit, s.Time.Verdict, s.Mem.Verdict)
+	}
+}
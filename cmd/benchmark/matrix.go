@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// versionSummary compares one version against the baseline over all
+// inputs: for a single input by the ratio of medians, and for a suite
+// by the geometric mean of the ratios.
+type versionSummary struct {
+	Version versionInfo `json:"version"`
+	Time    aggregate   `json:"time"`
+	Mem     aggregate   `json:"mem"`
+}
+
+// matrixRecord is the result of benchmarking several versions against
+// one baseline in a session.
+type matrixRecord struct {
+	Time        time.Time   `json:"time"`
+	Environment envInfo     `json:"environment"`
+	Baseline    versionInfo `json:"baseline"`
+	// Ranking is ordered by time ratio, fastest first.
+	Ranking []versionSummary `json:"ranking"`
+	// Records has the full comparison per version, in the order of
+	// --versions.
+	Records []*benchmarkRecord `json:"records"`
+	Noise   noiseInfo          `json:"noise"`
+}
+
+// aggregateVerdict tells whether the interval of a lies clear of 1.
+func aggregateVerdict(a aggregate) string {
+	switch {
+	case a.CI[0] > 1 && a.Name == "mem":
+		return "fatter"
+	case a.CI[0] > 1:
+		return "slower"
+	case a.CI[1] < 1 && a.Name == "mem":
+		return "leaner"
+	case a.CI[1] < 1:
+		return "faster"
+	}
+	return "neutral"
+}
+
+// summarize aggregates the samples selected by get over the inputs in
+// results. A single input gets the verdict of its comparison, which
+// also takes the Mann-Whitney test and the number of runs into
+// account.
+func summarize(name string, results []allResults, get func(*samples) []float64) aggregate {
+	a := aggregate{Name: name}
+	if len(results) == 1 {
+		c := analyzeData(get(results[0].base), get(results[0].vers), name)
+		a.Ratio, a.CI, a.Verdict = c.MedianRatio, c.MedianCI, c.Verdict
+		return a
+	}
+	var pairs []samplePair
+	for _, res := range results {
+		pairs = append(pairs, samplePair{get(res.base), get(res.vers)})
+	}
+	a.Ratio, a.CI[0], a.CI[1] = geomeanRatioCI(pairs, *bootstrapResamples, *confidence)
+	a.Verdict = aggregateVerdict(a)
+	return a
+}
+
+// rankVersions summarizes each version against the baseline, fastest
+// first.
+func rankVersions(versions []string, byVersion map[string][]allResults) []versionSummary {
+	var ranking []versionSummary
+	for _, v := range versions {
+		ranking = append(ranking, versionSummary{
+			Version: versionInfo{Commit: v},
+			Time:    summarize("time", byVersion[v], func(s *samples) []float64 { return s.Time }),
+			Mem:     summarize("mem", byVersion[v], func(s *samples) []float64 { return s.Mem }),
+		})
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		return ranking[i].Time.Ratio < ranking[j].Time.Ratio
+	})
+	return ranking
+}
+
+func newMatrix(base string, versions []string, byVersion map[string][]allResults) *matrixRecord {
+	m := &matrixRecord{
+		Time:        time.Now(),
+		Environment: getEnvInfo(),
+		Baseline:    versionInfo{base, describe(base)},
+		Ranking:     rankVersions(versions, byVersion),
+		Noise:       *noise,
+	}
+	for i := range m.Ranking {
+		m.Ranking[i].Version.Subject = describe(m.Ranking[i].Version.Commit)
+	}
+	for _, v := range versions {
+		m.Records = append(m.Records, newRecord(base, v, byVersion[v]))
+	}
+	return m
+}
+
+// report ranks the versions, and for a suite shows the time delta of
+// every version on every input.
+func (m *matrixRecord) report(byVersion map[string][]allResults) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "benchmark of %d versions\n\n%s\n", len(m.Ranking), environment())
+	fmt.Fprintf(&sb, "baseline %s - %s\n\n", m.Baseline.Commit, m.Baseline.Subject)
+
+	pct := func(r float64) string { return fmt.Sprintf("%+.2f %%", 100*(r-1)) }
+	tw := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(tw, "RANK\tVERSION\tTIME\t%g%% CI\tVERDICT\tMEM\tVERDICT\tSUBJECT\n", 100**confidence)
+	for i, s := range m.Ranking {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s .. %s\t%s\t%s\t%s\t%s\n", i+1, s.Version.Commit,
+			pct(s.Time.Ratio), pct(s.Time.CI[0]), pct(s.Time.CI[1]), s.Time.Verdict,
+			pct(s.Mem.Ratio), s.Mem.Verdict, s.Version.Subject)
+	}
+	tw.Flush()
+
+	first := byVersion[m.Ranking[0].Version.Commit]
+	if len(first) < 2 {
+		return sb.String()
+	}
+	sb.WriteString("\ntime per input:\n")
+	tw = tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "INPUT")
+	for _, s := range m.Ranking {
+		fmt.Fprintf(tw, "\t%s", s.Version.Commit)
+	}
+	fmt.Fprintln(tw)
+	for i, res := range first {
+		fmt.Fprint(tw, res.args[len(res.args)-1])
+		for _, s := range m.Ranking {
+			r := byVersion[s.Version.Commit][i]
+			fmt.Fprintf(tw, "\t%s", pct(median(r.vers.Time)/median(r.base.Time)))
+		}
+		fmt.Fprintln(tw)
+	}
+	tw.Flush()
+	return sb.String()
+}
+
+func (m *matrixRecord) writeJSON(fn string) error {
+	data, err := json.MarshalIndent(m, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0644)
+}
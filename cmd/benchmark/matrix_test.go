@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRankVersions(t *testing.T) {
+	flat := func(v float64) *samples {
+		s := &samples{}
+		for i := range 10 {
+			s.Time = append(s.Time, v+0.001*float64(i))
+			s.Mem = append(s.Mem, 100)
+		}
+		return s
+	}
+	base := flat(1)
+	byVersion := map[string][]allResults{}
+	for v, t := range map[string]float64{"slow": 1.5, "same": 1, "fast": 0.5} {
+		for _, in := range []string{"a.ly", "b.ly"} {
+			byVersion[v] = append(byVersion[v], allResults{
+				base: base, vers: flat(t), runCount: 10, args: []string{in},
+			})
+		}
+	}
+
+	ranking := rankVersions([]string{"slow", "same", "fast"}, byVersion)
+	var order []string
+	for _, s := range ranking {
+		order = append(order, s.Version.Commit)
+	}
+	if got := strings.Join(order, ","); got != "fast,same,slow" {
+		t.Errorf("got order %s", got)
+	}
+	for i, want := range []string{"faster", "neutral", "slower"} {
+		if got := ranking[i].Time.Verdict; got != want {
+			t.Errorf("%s: got verdict %q, want %q", ranking[i].Version.Commit, got, want)
+		}
+	}
+
+	m := &matrixRecord{Baseline: versionInfo{Commit: "base"}, Ranking: ranking}
+	r := m.report(byVersion)
+	for _, want := range []string{`\n1 +fast `, `\n3 +slow `, `time per input:`, `\na\.ly +-49`} {
+		if !regexp.MustCompile(want).MatchString(r) {
+			t.Errorf("report misses %q:\n%s", want, r)
+		}
+	}
+}
+
+func TestSummarizeSingleInput(t *testing.T) {
+	results := []allResults{{
+		base:     &samples{Time: []float64{1, 1.2, 0.8}, Mem: []float64{100, 100, 100}},
+		vers:     &samples{Time: []float64{1.1, 0.9, 1.3}, Mem: []float64{100, 100, 100}},
+		runCount: 3,
+	}}
+	tm := summarize("time", results, func(s *samples) []float64 { return s.Time })
+	if tm.Verdict != "inconclusive, need more runs" {
+		t.Errorf("time: got verdict %q", tm.Verdict)
+	}
+	mem := summarize("mem", results, func(s *samples) []float64 { return s.Mem })
+	if mem.Verdict != "neutral" || mem.Ratio != 1 {
+		t.Errorf("mem: got %+v", mem)
+	}
+}
+
+func TestAggregateVerdict(t *testing.T) {
+	for _, tc := range []struct {
+		a    aggregate
+		want string
+	}{
+		{aggregate{Name: "time", CI: [2]float64{1.01, 1.1}}, "slower"},
+		{aggregate{Name: "mem", CI: [2]float64{0.8, 0.9}}, "leaner"},
+		{aggregate{Name: "time", CI: [2]float64{0.9, 1.1}}, "neutral"},
+	} {
+		if got := aggregateVerdict(tc.a); got != tc.want {
+			t.Errorf("%+v: got %q, want %q", tc.a, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	warmup       = flag.Int("warmup", 1, "runs per version and input before measuring, which are discarded")
+	cpuList      = flag.String("cpus", "", "CPU list (e.g. 2,3 or 2-3) to pin the benchmarked runs to")
+	seed         = flag.Uint64("seed", 0, "seed for the random order of the versions; 0 picks one")
+	maxLoad      = flag.Float64("max_load", 1.5, "maximum 1-minute load average before a round, 0 to disable; the benchmark itself adds about 1")
+	busyCPU      = flag.Float64("busy_cpu", 0.1, "fraction of a CPU above which another process counts as busy, 0 to disable")
+	quietTimeout = flag.Duration("quiet_timeout", 5*time.Minute, "how long to wait for a quiet machine before aborting")
+)
+
+const (
+	// busySample is the interval over which the CPU use of other
+	// processes is measured.
+	busySample = time.Second
+	// quietPoll is the interval between checks while waiting.
+	quietPoll = 10 * time.Second
+	// clockTicks is USER_HZ, the unit of the times in /proc/PID/stat.
+	clockTicks = 100
+)
+
+// noiseInfo records the measures against noise, and what the quiet
+// checks found.
+type noiseInfo struct {
+	Warmup  int     `json:"warmup"`
+	CPUs    string  `json:"cpus,omitempty"`
+	Seed    uint64  `json:"seed"`
+	MaxLoad float64 `json:"max_load"`
+	BusyCPU float64 `json:"busy_cpu"`
+
+	Checks        int     `json:"checks"`
+	PausedSeconds float64 `json:"paused_s"`
+	// Loads is the 1-minute load average at each check.
+	Loads []float64 `json:"loads,omitempty"`
+	// Busy lists the processes that made the benchmark wait.
+	Busy []string `json:"busy,omitempty"`
+}
+
+var (
+	noise = &noiseInfo{}
+	// order shuffles the versions of each round.
+	order = rand.New(rand.NewPCG(0, 0))
+	// pinned is the CPU set for runs, if any.
+	pinned *cpuMask
+)
+
+// setupNoise applies the noise flags.
+func setupNoise() error {
+	s := *seed
+	if s == 0 {
+		s = uint64(time.Now().UnixNano())
+	}
+	order = rand.New(rand.NewPCG(s, 0))
+	noise = &noiseInfo{
+		Warmup:  *warmup,
+		CPUs:    *cpuList,
+		Seed:    s,
+		MaxLoad: *maxLoad,
+		BusyCPU: *busyCPU,
+	}
+	if *cpuList != "" {
+		m, err := parseCPUList(*cpuList)
+		if err != nil {
+			return err
+		}
+		pinned = m
+	}
+	return nil
+}
+
+// String summarizes n for the reports.
+func (n *noiseInfo) String() string {
+	s := fmt.Sprintf("warmup %d, seed %d", n.Warmup, n.Seed)
+	if n.CPUs != "" {
+		s += ", cpus " + n.CPUs
+	}
+	if n.Checks > 0 {
+		s += fmt.Sprintf(", %d quiet checks, paused %.0fs", n.Checks, n.PausedSeconds)
+	}
+	if len(n.Busy) > 0 {
+		s += fmt.Sprintf(", %d busy processes seen", len(n.Busy))
+	}
+	return s
+}
+
+// cpuMask is a cpu_set_t for 1024 CPUs.
+type cpuMask [16]uint64
+
+func (m *cpuMask) set(cpu int) {
+	m[cpu/64] |= 1 << (cpu % 64)
+}
+
+func (m *cpuMask) isSet(cpu int) bool {
+	return m[cpu/64]&(1<<(cpu%64)) != 0
+}
+
+// parseCPUList parses a list like "0,2-3" as in taskset -c.
+func parseCPUList(s string) (*cpuMask, error) {
+	m := &cpuMask{}
+	for part := range strings.SplitSeq(s, ",") {
+		lo, hi, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil {
+			return nil, fmt.Errorf("cpu list %q: %v", s, err)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil {
+				return nil, fmt.Errorf("cpu list %q: %v", s, err)
+			}
+		}
+		if first < 0 || last < first || last >= 64*len(m) {
+			return nil, fmt.Errorf("cpu list %q: bad range %q", s, part)
+		}
+		for c := first; c <= last; c++ {
+			m.set(c)
+		}
+	}
+	return m, nil
+}
+
+func schedAffinity(trap uintptr, m *cpuMask) error {
+	_, _, errno := syscall.RawSyscall(trap, 0, unsafe.Sizeof(*m), uintptr(unsafe.Pointer(m)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// startPinned starts cmd on the pinned CPUs. The child inherits the
+// affinity of the thread that forks it, so the affinity of a locked
+// thread is set for the duration of the fork.
+func startPinned(cmd *exec.Cmd) error {
+	if pinned == nil {
+		return cmd.Start()
+	}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	var old cpuMask
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &old); err != nil {
+		return fmt.Errorf("sched_getaffinity: %v", err)
+	}
+	if err := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, pinned); err != nil {
+		return fmt.Errorf("sched_setaffinity %s: %v", *cpuList, err)
+	}
+	err := cmd.Start()
+	if rerr := schedAffinity(syscall.SYS_SCHED_SETAFFINITY, &old); rerr != nil && err == nil {
+		err = fmt.Errorf("restoring affinity: %v", rerr)
+	}
+	return err
+}
+
+func loadAverage() (float64, error) {
+	content, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("empty /proc/loadavg")
+	}
+	return strconv.ParseFloat(fields[0], 64)
+}
+
+// procCPU is the CPU time of a process, in clock ticks.
+type procCPU struct {
+	comm  string
+	ticks int64
+}
+
+// parseProcStat parses the name and user+system time from the
+// contents of /proc/PID/stat.
+func parseProcStat(stat string) (procCPU, error) {
+	lp, rp := strings.IndexByte(stat, '('), strings.LastIndexByte(stat, ')')
+	if lp < 0 || rp < lp {
+		return procCPU{}, fmt.Errorf("malformed stat %q", stat)
+	}
+	// The fields after the name start at the state, field 3; utime
+	// and stime are fields 14 and 15.
+	fields := strings.Fields(stat[rp+1:])
+	if len(fields) < 13 {
+		return procCPU{}, fmt.Errorf("short stat %q", stat)
+	}
+	utime, err := strconv.ParseInt(fields[11], 10, 64)
+	if err != nil {
+		return procCPU{}, err
+	}
+	stime, err := strconv.ParseInt(fields[12], 10, 64)
+	if err != nil {
+		return procCPU{}, err
+	}
+	return procCPU{comm: stat[lp+1 : rp], ticks: utime + stime}, nil
+}
+
+// processCPU returns the CPU time of all processes but this one, by
+// PID.
+func processCPU() map[int]procCPU {
+	result := map[int]procCPU{}
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, fn := range stats {
+		pid, err := strconv.Atoi(filepath.Base(filepath.Dir(fn)))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		// Processes may exit while we look.
+		content, err := os.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		if p, err := parseProcStat(string(content)); err == nil {
+			result[pid] = p
+		}
+	}
+	return result
+}
+
+// busyProcesses returns the processes that used more than threshold
+// of a CPU between the before and after snapshots, taken interval
+// apart.
+func busyProcesses(before, after map[int]procCPU, interval time.Duration, threshold float64) []string {
+	var busy []string
+	for pid, a := range after {
+		b, ok := before[pid]
+		if !ok {
+			continue
+		}
+		use := float64(a.ticks-b.ticks) / clockTicks / interval.Seconds()
+		if use > threshold {
+			busy = append(busy, fmt.Sprintf("%s[%d] %.0f%%", a.comm, pid, 100*use))
+		}
+	}
+	sort.Strings(busy)
+	return busy
+}
+
+// checkQuiet returns a description of what makes the machine noisy,
+// or "" if it is quiet.
+func checkQuiet() (string, error) {
+	var problems []string
+	load, err := loadAverage()
+	if err != nil {
+		return "", err
+	}
+	noise.Loads = append(noise.Loads, load)
+	if *maxLoad > 0 && load > *maxLoad {
+		problems = append(problems, fmt.Sprintf("load %.2f > %.2f", load, *maxLoad))
+	}
+	if *busyCPU > 0 {
+		before := processCPU()
+		time.Sleep(busySample)
+		busy := busyProcesses(before, processCPU(), busySample, *busyCPU)
+		noise.Busy = append(noise.Busy, busy...)
+		if len(busy) > 0 {
+			problems = append(problems, "busy: "+strings.Join(busy, ", "))
+		}
+	}
+	return strings.Join(problems, "; "), nil
+}
+
+// waitQuiet waits until the machine is quiet, and fails if it is not
+// within --quiet_timeout.
+func waitQuiet() error {
+	if *maxLoad <= 0 && *busyCPU <= 0 {
+		return nil
+	}
+	start := time.Now()
+	for {
+		noise.Checks++
+		problem, err := checkQuiet()
+		if err != nil {
+			return err
+		}
+		if problem == "" {
+			return nil
+		}
+		if time.Since(start) >= *quietTimeout {
+			return fmt.Errorf("machine not quiet after %s: %s", *quietTimeout, problem)
+		}
+		log.Printf("waiting for a quiet machine: %s", problem)
+		t := time.Now()
+		time.Sleep(quietPoll)
+		noise.PausedSeconds += time.Since(t).Seconds()
+	}
+}
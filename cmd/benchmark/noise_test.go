@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestParseCPUList(t *testing.T) {
+	m, err := parseCPUList("0, 2-4,70")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for c := range 64 * len(m) {
+		if m.isSet(c) {
+			got = append(got, c)
+		}
+	}
+	if want := []int{0, 2, 3, 4, 70}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, bad := range []string{"", "a", "3-1", "-1", "5000"} {
+		if _, err := parseCPUList(bad); err == nil {
+			t.Errorf("%q: want error", bad)
+		}
+	}
+}
+
+func TestParseProcStat(t *testing.T) {
+	stat := "1234 (tmux: server) S 1 1234 1234 0 -1 4194560 2000 0 0 0 150 25 0 0 20 0 1 0 100 0 0\n"
+	got, err := parseProcStat(stat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (procCPU{comm: "tmux: server", ticks: 175}); got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if _, err := parseProcStat("1234 (x) S 1"); err == nil {
+		t.Error("want error for short stat")
+	}
+}
+
+func TestBusyProcesses(t *testing.T) {
+	before := map[int]procCPU{1: {"init", 10}, 2: {"make", 100}, 3: {"gone", 0}}
+	after := map[int]procCPU{1: {"init", 11}, 2: {"make", 250}, 4: {"new", 500}}
+	got := busyProcesses(before, after, 2*time.Second, 0.1)
+	if want := []string{"make[2] 75%"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStartPinned(t *testing.T) {
+	var allowed cpuMask
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &allowed); err != nil {
+		t.Fatal(err)
+	}
+	cpu := 0
+	for !allowed.isSet(cpu) {
+		cpu++
+	}
+
+	m, err := parseCPUList(fmt.Sprint(cpu))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pinned = m
+	defer func() { pinned = nil }()
+
+	out := filepath.Join(t.TempDir(), "out")
+	cmd := exec.Command("/bin/sh", "-c", "grep Cpus_allowed_list /proc/self/status > "+out)
+	if err := startPinned(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(strings.TrimPrefix(string(content), "Cpus_allowed_list:")); got != fmt.Sprint(cpu) {
+		t.Errorf("child allowed on %q, want %d", got, cpu)
+	}
+
+	var now cpuMask
+	if err := schedAffinity(syscall.SYS_SCHED_GETAFFINITY, &now); err != nil {
+		t.Fatal(err)
+	}
+	if now != allowed {
+		t.Errorf("affinity not restored")
+	}
+}
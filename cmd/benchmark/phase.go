@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// phaseMarkers are the progress messages with which LilyPond starts
+// each phase of a run. Everything before the first is "startup".
+var phaseMarkers = []struct {
+	marker, name string
+}{
+	{"Parsing...", "parsing"},
+	{"Interpreting music...", "interpreting"},
+	{"Preprocessing graphical objects...", "preprocessing"},
+	{"Finding the ideal number of pages...", "page-breaking"},
+	{"Drawing systems...", "drawing"},
+}
+
+// phaseNames returns the names of all phases, in order.
+func phaseNames() []string {
+	names := []string{"startup"}
+	for _, m := range phaseMarkers {
+		names = append(names, m.name)
+	}
+	return names
+}
+
+// phaseWriter passes output through to w, and times the phases by
+// when their progress messages arrive. A phase lasts until the next
+// one starts; a phase that recurs, eg. for several input files, adds
+// up.
+type phaseWriter struct {
+	w   io.Writer
+	now func() time.Time
+
+	// pending is the tail of the output that may hold the start of
+	// a marker.
+	pending []byte
+
+	phase string
+	start time.Time
+	// durations is in seconds, by phase name.
+	durations map[string]float64
+}
+
+func newPhaseWriter(w io.Writer, start time.Time) *phaseWriter {
+	return &phaseWriter{
+		w:         w,
+		now:       time.Now,
+		phase:     "startup",
+		start:     start,
+		durations: map[string]float64{},
+	}
+}
+
+func (pw *phaseWriter) switchTo(phase string, t time.Time) {
+	pw.durations[pw.phase] += t.Sub(pw.start).Seconds()
+	pw.phase = phase
+	pw.start = t
+}
+
+func (pw *phaseWriter) Write(p []byte) (int, error) {
+	t := pw.now()
+	buf := append(pw.pending, p...)
+	for {
+		idx, next := -1, -1
+		for i, m := range phaseMarkers {
+			j := bytes.Index(buf, []byte(m.marker))
+			if j >= 0 && (idx < 0 || j < idx) {
+				idx, next = j, i
+			}
+		}
+		if idx < 0 {
+			break
+		}
+		pw.switchTo(phaseMarkers[next].name, t)
+		buf = buf[idx+len(phaseMarkers[next].marker):]
+	}
+
+	keep := 0
+	for _, m := range phaseMarkers {
+		keep = max(keep, len(m.marker)-1)
+	}
+	pw.pending = bytes.Clone(buf[max(len(buf)-keep, 0):])
+	return pw.w.Write(p)
+}
+
+// finish ends the current phase at t, and returns the durations.
+func (pw *phaseWriter) finish(t time.Time) map[string]float64 {
+	pw.switchTo("", t)
+	return pw.durations
+}
+
+// phaseComparisons compares the phase durations of vers against base,
+// for the phases that took measurable time in every run.
+func phaseComparisons(base, vers *samples) []*comparison {
+	var cs []*comparison
+	for _, n := range phaseNames() {
+		b, v := base.Phases[n], vers.Phases[n]
+		if !positiveSamples(b, v) {
+			continue
+		}
+		cs = append(cs, analyzeData(b, v, n))
+	}
+	return cs
+}
+
+// phaseReport shows the median wall time per phase, and its change.
+func phaseReport(cs []*comparison) string {
+	if len(cs) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteString("phases (wall time):\n")
+	tw := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "    PHASE\tBASELINE\tVERSION\tDELTA\tVERDICT")
+	for _, c := range cs {
+		fmt.Fprintf(tw, "    %s\t%.3f\t%.3f\t%+.2f %%\t%s\n", c.Name,
+			c.BaseMedian, c.VersMedian, 100*(c.MedianRatio-1), c.Verdict)
+	}
+	tw.Flush()
+	return sb.String()
+}
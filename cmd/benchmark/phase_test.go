@@ -0,0 +1,88 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseWriter(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := start
+	var out strings.Builder
+	pw := newPhaseWriter(&out, start)
+	pw.now = func() time.Time { return clock }
+
+	for _, w := range []struct {
+		after time.Duration
+		text  string
+	}{
+		{time.Second, "GNU LilyPond 2.25.0\nProcessing `a.ly'\nPars"},
+		// The marker is split over two writes.
+		{2 * time.Second, "ing...\n"},
+		{3 * time.Second, "Interpreting music...[8][16]"},
+		{4 * time.Second, "\nPreprocessing graphical objects...\nFinding the ideal number of pages...\n"},
+		{5 * time.Second, "Fitting music on 1 page...\nDrawing systems...\n"},
+	} {
+		clock = clock.Add(w.after)
+		if _, err := pw.Write([]byte(w.text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := pw.finish(clock.Add(6 * time.Second))
+
+	want := map[string]float64{
+		"startup":       3,
+		"parsing":       3,
+		"interpreting":  4,
+		"preprocessing": 0,
+		"page-breaking": 5,
+		"drawing":       6,
+	}
+	for n, d := range want {
+		if got[n] != d {
+			t.Errorf("%s: got %g, want %g", n, got[n], d)
+		}
+	}
+	if !strings.Contains(out.String(), "Parsing...\nInterpreting music...") {
+		t.Errorf("output not passed through: %q", out.String())
+	}
+}
+
+func TestPhaseWriterRepeated(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := start
+	pw := newPhaseWriter(&strings.Builder{}, start)
+	pw.now = func() time.Time { return clock }
+	for _, text := range []string{"Parsing...", "Interpreting music...", "Parsing...", "Interpreting music..."} {
+		clock = clock.Add(time.Second)
+		pw.Write([]byte(text))
+	}
+	got := pw.finish(clock.Add(time.Second))
+	if got["parsing"] != 2 || got["interpreting"] != 2 || got["startup"] != 1 {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestPhaseComparisons(t *testing.T) {
+	base := &samples{Phases: map[string][]float64{
+		"parsing":      {1, 1, 1, 1},
+		"interpreting": {2, 2, 2, 2},
+		"drawing":      {0, 0, 0, 0},
+	}}
+	vers := &samples{Phases: map[string][]float64{
+		"parsing":      {1, 1, 1, 1},
+		"interpreting": {3, 3, 3, 3},
+		"drawing":      {0, 0, 0, 0},
+	}}
+	cs := phaseComparisons(base, vers)
+	if len(cs) != 2 || cs[0].Name != "parsing" || cs[1].Name != "interpreting" {
+		t.Fatalf("got %v", cs)
+	}
+	if cs[1].MedianRatio != 1.5 {
+		t.Errorf("interpreting ratio %g", cs[1].MedianRatio)
+	}
+	if r := phaseReport(cs); !strings.Contains(r, "interpreting") || !strings.Contains(r, "+50.00 %") {
+		t.Errorf("report %q", r)
+	}
+}
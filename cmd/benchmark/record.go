@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envInfo describes the machine a benchmark ran on.
+type envInfo struct {
+	Hostname string `json:"hostname"`
+	CPU      string `json:"cpu"`
+	NumCPU   int    `json:"num_cpu"`
+	// FreqKhz holds the cpufreq settings of cpu0, by sysfs name.
+	FreqKhz map[string]int `json:"freq_khz,omitempty"`
+	Kernel  string         `json:"kernel"`
+}
+
+func getEnvInfo() envInfo {
+	e := envInfo{NumCPU: runtime.NumCPU()}
+	e.Hostname, _ = os.Hostname()
+	e.CPU, _ = getCPUType()
+	e.FreqKhz, _ = getCPUSpeedsKhz()
+	if content, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		e.Kernel = strings.TrimSpace(string(content))
+	}
+	return e
+}
+
+// versionInfo is a benchmarked commit.
+type versionInfo struct {
+	Commit  string `json:"commit"`
+	Subject string `json:"subject"`
+}
+
+// samples holds the measurements of one version, per run. Times are
+// in seconds, memory in kilobytes. Time is the user CPU time, and Mem
+// the maximum resident set size.
+type samples struct {
+	Time             []float64 `json:"time"`
+	Mem              []float64 `json:"mem"`
+	Sys              []float64 `json:"sys,omitempty"`
+	Wall             []float64 `json:"wall,omitempty"`
+	MinorFaults      []int64   `json:"minor_faults,omitempty"`
+	MajorFaults      []int64   `json:"major_faults,omitempty"`
+	VolCtxSwitches   []int64   `json:"vol_ctx_switches,omitempty"`
+	InvolCtxSwitches []int64   `json:"invol_ctx_switches,omitempty"`
+	// RSS is the memory profile of each run, see runStats.
+	RSS [][]float64 `json:"rss,omitempty"`
+	// Phases is the wall time per phase, by phase name.
+	Phases map[string][]float64 `json:"phases,omitempty"`
+}
+
+func (s *samples) add(st *runStats) {
+	s.Time = append(s.Time, st.UserTime)
+	s.Mem = append(s.Mem, st.MaxRSS)
+	s.Sys = append(s.Sys, st.SysTime)
+	s.Wall = append(s.Wall, st.WallTime)
+	s.MinorFaults = append(s.MinorFaults, st.MinorFaults)
+	s.MajorFaults = append(s.MajorFaults, st.MajorFaults)
+	s.VolCtxSwitches = append(s.VolCtxSwitches, st.VolCtxSwitches)
+	s.InvolCtxSwitches = append(s.InvolCtxSwitches, st.InvolCtxSwitches)
+	s.RSS = append(s.RSS, st.RSS)
+	if s.Phases == nil {
+		s.Phases = map[string][]float64{}
+	}
+	for _, n := range phaseNames() {
+		s.Phases[n] = append(s.Phases[n], st.Phases[n])
+	}
+}
+
+// merge appends the runs of o.
+func (s *samples) merge(o *samples) {
+	s.Time = append(s.Time, o.Time...)
+	s.Mem = append(s.Mem, o.Mem...)
+	s.Sys = append(s.Sys, o.Sys...)
+	s.Wall = append(s.Wall, o.Wall...)
+	s.MinorFaults = append(s.MinorFaults, o.MinorFaults...)
+	s.MajorFaults = append(s.MajorFaults, o.MajorFaults...)
+	s.VolCtxSwitches = append(s.VolCtxSwitches, o.VolCtxSwitches...)
+	s.InvolCtxSwitches = append(s.InvolCtxSwitches, o.InvolCtxSwitches...)
+	s.RSS = append(s.RSS, o.RSS...)
+	for n, ds := range o.Phases {
+		if s.Phases == nil {
+			s.Phases = map[string][]float64{}
+		}
+		s.Phases[n] = append(s.Phases[n], ds...)
+	}
+}
+
+// withoutProfiles returns s without the memory profiles, which are
+// too bulky to keep in the history.
+func (s *samples) withoutProfiles() samples {
+	c := *s
+	c.RSS = nil
+	return c
+}
+
+// positiveSamples reports whether xs and ys can be compared by their
+// ratios: both must have samples, and none may be zero. The system
+// time is sampled in clock ticks, so short runs often measure 0.
+func positiveSamples(xs, ys []float64) bool {
+	if len(xs) == 0 || len(ys) == 0 {
+		return false
+	}
+	for _, v := range append(append([]float64(nil), xs...), ys...) {
+		if v <= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// comparisons compares the measurements of s against base. The
+// optional measurements are left out if they cannot be compared.
+func (s *samples) comparisons(base *samples) []*comparison {
+	cs := []*comparison{
+		analyzeData(base.Time, s.Time, "time"),
+		analyzeData(base.Mem, s.Mem, "mem"),
+	}
+	if positiveSamples(base.Sys, s.Sys) {
+		cs = append(cs, analyzeData(base.Sys, s.Sys, "sys"))
+	}
+	if positiveSamples(base.Wall, s.Wall) {
+		cs = append(cs, analyzeData(base.Wall, s.Wall, "wall"))
+	}
+	return cs
+}
+
+// inputRecord is the benchmark of one argument list.
+type inputRecord struct {
+	Args     []string      `json:"args"`
+	Baseline samples       `json:"baseline"`
+	Version  samples       `json:"version"`
+	Stats    []*comparison `json:"stats"`
+	Phases   []*comparison `json:"phases,omitempty"`
+}
+
+// aggregate is the geometric mean over all inputs of the ratio of
+// medians.
+type aggregate struct {
+	Name    string     `json:"name"`
+	Ratio   float64    `json:"ratio"`
+	CI      [2]float64 `json:"ci"`
+	Verdict string     `json:"verdict,omitempty"`
+}
+
+// benchmarkRecord is the machine readable result of a benchmark run.
+type benchmarkRecord struct {
+	Time        time.Time     `json:"time"`
+	Environment envInfo       `json:"environment"`
+	Baseline    versionInfo   `json:"baseline"`
+	Version     versionInfo   `json:"version"`
+	RunCount    int           `json:"run_count"`
+	Confidence  float64       `json:"confidence"`
+	Inputs      []inputRecord `json:"inputs"`
+	Aggregates  []aggregate   `json:"aggregates,omitempty"`
+	Noise       noiseInfo     `json:"noise"`
+}
+
+// newRecord computes the statistics for the results of benchmarking
+// vers against base.
+func newRecord(base, vers string, results []allResults) *benchmarkRecord {
+	r := &benchmarkRecord{
+		Time:        time.Now(),
+		Environment: getEnvInfo(),
+		Baseline:    versionInfo{base, describe(base)},
+		Version:     versionInfo{vers, describe(vers)},
+		Confidence:  *confidence,
+		Noise:       *noise,
+	}
+	var times, mems []samplePair
+	for _, res := range results {
+		r.RunCount = max(r.RunCount, res.runCount)
+		r.Inputs = append(r.Inputs, inputRecord{
+			Args:     res.args,
+			Baseline: *res.base,
+			Version:  *res.vers,
+			Stats:    res.vers.comparisons(res.base),
+			Phases:   phaseComparisons(res.base, res.vers),
+		})
+		times = append(times, samplePair{res.base.Time, res.vers.Time})
+		mems = append(mems, samplePair{res.base.Mem, res.vers.Mem})
+	}
+	if len(results) > 1 {
+		for _, agg := range []struct {
+			name  string
+			pairs []samplePair
+		}{{"time", times}, {"mem", mems}} {
+			a := aggregate{Name: agg.name}
+			a.Ratio, a.CI[0], a.CI[1] = geomeanRatioCI(agg.pairs, *bootstrapResamples, *confidence)
+			a.Verdict = aggregateVerdict(a)
+			r.Aggregates = append(r.Aggregates, a)
+		}
+	}
+	return r
+}
+
+func (r *benchmarkRecord) writeJSON(fn string) error {
+	data, err := json.MarshalIndent(r, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0644)
+}
+
+// writeCSV writes the raw samples, one row per run. Missing
+// measurements are left empty.
+func (r *benchmarkRecord) writeCSV(w io.Writer) error {
+	float := func(fs []float64, i int) string {
+		if i >= len(fs) {
+			return ""
+		}
+		return strconv.FormatFloat(fs[i], 'f', -1, 64)
+	}
+	integer := func(is []int64, i int) string {
+		if i >= len(is) {
+			return ""
+		}
+		return strconv.FormatInt(is[i], 10)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"args", "version", "commit", "run", "user_time_s", "max_rss_kb",
+		"sys_time_s", "wall_time_s", "minor_faults", "major_faults", "vol_ctx_switches", "invol_ctx_switches"})
+	for _, in := range r.Inputs {
+		args := strings.Join(in.Args, " ")
+		for _, v := range []struct {
+			name    string
+			commit  string
+			samples samples
+		}{
+			{"baseline", r.Baseline.Commit, in.Baseline},
+			{"version", r.Version.Commit, in.Version},
+		} {
+			s := &v.samples
+			for i := range s.Time {
+				cw.Write([]string{args, v.name, v.commit, strconv.Itoa(i),
+					float(s.Time, i), float(s.Mem, i), float(s.Sys, i), float(s.Wall, i),
+					integer(s.MinorFaults, i), integer(s.MajorFaults, i),
+					integer(s.VolCtxSwitches, i), integer(s.InvolCtxSwitches, i)})
+			}
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *benchmarkRecord) writeCSVFile(fn string) error {
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	if err := r.writeCSV(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
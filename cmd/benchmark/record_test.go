@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestWriteCSV(t *testing.T) {
+	r := &benchmarkRecord{
+		Baseline: versionInfo{Commit: "abc"},
+		Version:  versionInfo{Commit: "def"},
+		Inputs: []inputRecord{{
+			Args:     []string{"-dbackend=null", "a.ly"},
+			Baseline: samples{Time: []float64{1.5, 1.25}, Mem: []float64{100, 101}},
+			Version: samples{Time: []float64{2}, Mem: []float64{200}, Sys: []float64{0.5}, Wall: []float64{2.75},
+				MinorFaults: []int64{10}, MajorFaults: []int64{1}, VolCtxSwitches: []int64{3}, InvolCtxSwitches: []int64{4}},
+		}},
+	}
+	var sb strings.Builder
+	if err := r.writeCSV(&sb); err != nil {
+		t.Fatal(err)
+	}
+	want := `args,version,commit,run,user_time_s,max_rss_kb,sys_time_s,wall_time_s,minor_faults,major_faults,vol_ctx_switches,invol_ctx_switches
+-dbackend=null a.ly,baseline,abc,0,1.5,100,,,,,,
+-dbackend=null a.ly,baseline,abc,1,1.25,101,,,,,,
+-dbackend=null a.ly,version,def,0,2,200,0.5,2.75,10,1,3,4
+`
+	if got := sb.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestComparisonsZeroSamples(t *testing.T) {
+	base := &samples{Time: []float64{1, 1.1, 1.2}, Mem: []float64{100, 100, 100},
+		Sys: []float64{0, 0.01, 0}, Wall: []float64{1.5, 1.6, 1.7},
+		Phases: map[string][]float64{"parsing": {0.5, 0, 0.5}}}
+	vers := &samples{Time: []float64{1, 1.1, 1.2}, Mem: []float64{100, 100, 100},
+		Sys: []float64{0.01, 0.01, 0.01}, Wall: []float64{1.5, 1.6, 1.7},
+		Phases: map[string][]float64{"parsing": {0.5, 0.5, 0.5}}}
+
+	cs := vers.comparisons(base)
+	var names []string
+	for _, c := range cs {
+		names = append(names, c.Name)
+	}
+	if got := strings.Join(names, " "); got != "time mem wall" {
+		t.Errorf("got comparisons %q, want time mem wall", got)
+	}
+	phases := phaseComparisons(base, vers)
+	if len(phases) != 0 {
+		t.Errorf("got phase comparisons %v", phases)
+	}
+	if _, err := json.Marshal(inputRecord{Stats: cs, Phases: phases}); err != nil {
+		t.Errorf("json: %v", err)
+	}
+}
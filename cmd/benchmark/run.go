@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var sampleInterval = flag.Duration("sample_interval", 100*time.Millisecond, "interval for sampling the memory use of a run")
+
+// runStats is the resource use of one run.
+type runStats struct {
+	// UserTime, SysTime and WallTime are in seconds.
+	UserTime float64
+	SysTime  float64
+	WallTime float64
+	// MaxRSS is the peak resident set size in kilobytes.
+	MaxRSS           float64
+	MinorFaults      int64
+	MajorFaults      int64
+	VolCtxSwitches   int64
+	InvolCtxSwitches int64
+	// RSS is the resident set size in kilobytes, sampled every
+	// --sample_interval.
+	RSS []float64
+	// Phases is the wall time in seconds per phase, see phaseWriter.
+	Phases map[string]float64
+}
+
+// procRSS returns the resident set size of process pid in kilobytes.
+func procRSS(pid int) (float64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if v, ok := strings.CutPrefix(scanner.Text(), "VmRSS:"); ok {
+			return strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), " kB"), 64)
+		}
+	}
+	return 0, fmt.Errorf("no VmRSS for pid %d", pid)
+}
+
+func timevalSeconds(tv syscall.Timeval) float64 {
+	return float64(tv.Sec) + float64(tv.Usec)/1e6
+}
+
+// runLilypond runs bin with args, with its output going to the file
+// out, and returns its resource use: the rusage of the process, the
+// resident set size sampled from /proc, and the phase durations.
+func runLilypond(bin string, args []string, out string) (*runStats, error) {
+	f, err := os.Create(out)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cmd := exec.Command(bin, args...)
+	start := time.Now()
+	pw := newPhaseWriter(f, start)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := startPinned(cmd); err != nil {
+		return nil, err
+	}
+
+	st := &runStats{}
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(*sampleInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// The process may have exited already.
+				if rss, err := procRSS(cmd.Process.Pid); err == nil {
+					st.RSS = append(st.RSS, rss)
+				}
+			}
+		}
+	}()
+
+	err = cmd.Wait()
+	end := time.Now()
+	st.WallTime = end.Sub(start).Seconds()
+	st.Phases = pw.finish(end)
+	close(done)
+	<-sampled
+	if err != nil {
+		return nil, fmt.Errorf("%s %v: %v (output in %s)", bin, args, err, out)
+	}
+
+	ru, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage)
+	if !ok {
+		return nil, fmt.Errorf("no rusage for %s", bin)
+	}
+	st.UserTime = timevalSeconds(ru.Utime)
+	st.SysTime = timevalSeconds(ru.Stime)
+	// Linux reports ru_maxrss in kilobytes.
+	st.MaxRSS = float64(ru.Maxrss)
+	st.MinorFaults = ru.Minflt
+	st.MajorFaults = ru.Majflt
+	st.VolCtxSwitches = ru.Nvcsw
+	st.InvolCtxSwitches = ru.Nivcsw
+	return st, nil
+}
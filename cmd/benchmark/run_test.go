@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunLilypond(t *testing.T) {
+	*sampleInterval = time.Millisecond
+	out := filepath.Join(t.TempDir(), "out.txt")
+	st, err := runLilypond("/bin/sh", []string{"-c", "i=0; while [ $i -lt 20000 ]; do i=$((i+1)); done"}, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.MaxRSS <= 0 {
+		t.Errorf("MaxRSS %g", st.MaxRSS)
+	}
+	if st.WallTime <= 0 || st.UserTime+st.SysTime > st.WallTime+0.1 {
+		t.Errorf("times: user %g sys %g wall %g", st.UserTime, st.SysTime, st.WallTime)
+	}
+	if len(st.RSS) == 0 {
+		t.Errorf("no RSS samples")
+	}
+
+	if _, err := runLilypond("/bin/sh", []string{"-c", "exit 1"}, out); err == nil {
+		t.Errorf("want error for failing run")
+	}
+}
+
+func TestProcRSS(t *testing.T) {
+	if _, err := procRSS(1 << 30); err == nil {
+		t.Errorf("want error for missing process")
+	}
+}
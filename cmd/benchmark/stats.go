@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sort"
+)
+
+func median(fs []float64) float64 {
+	s := append([]float64(nil), fs...)
+	sort.Float64s(s)
+	n := len(s)
+	if n%2 == 1 {
+		return s[n/2]
+	}
+	return (s[n/2-1] + s[n/2]) / 2
+}
+
+// percentileSorted returns the p-quantile (0 <= p <= 1) of sorted fs,
+// interpolating linearly.
+func percentileSorted(fs []float64, p float64) float64 {
+	pos := p * float64(len(fs)-1)
+	i := int(pos)
+	if i+1 >= len(fs) {
+		return fs[len(fs)-1]
+	}
+	frac := pos - float64(i)
+	return fs[i]*(1-frac) + fs[i+1]*frac
+}
+
+// bootstrapRatioCI returns a percentile bootstrap confidence interval
+// for stat(vers)/stat(base), resampling both samples independently.
+func bootstrapRatioCI(base, vers []float64, stat func([]float64) float64, resamples int, confidence float64, rng *rand.Rand) (lo, hi float64) {
+	resample := func(dst, src []float64) {
+		for i := range dst {
+			dst[i] = src[rng.IntN(len(src))]
+		}
+	}
+	b := make([]float64, len(base))
+	v := make([]float64, len(vers))
+	ratios := make([]float64, resamples)
+	for i := range ratios {
+		resample(b, base)
+		resample(v, vers)
+		ratios[i] = stat(v) / stat(b)
+	}
+	sort.Float64s(ratios)
+	alpha := 1 - confidence
+	return percentileSorted(ratios, alpha/2), percentileSorted(ratios, 1-alpha/2)
+}
+
+// ranks returns the ranks (1-based) of the values in the combined
+// sample, averaging ties, and the tie correction term sum(t^3 - t).
+func ranks(all []float64) ([]float64, float64) {
+	idx := make([]int, len(all))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool { return all[idx[i]] < all[idx[j]] })
+
+	r := make([]float64, len(all))
+	ties := 0.0
+	for i := 0; i < len(idx); {
+		j := i
+		for j < len(idx) && all[idx[j]] == all[idx[i]] {
+			j++
+		}
+		avg := float64(i+j+1) / 2
+		for k := i; k < j; k++ {
+			r[idx[k]] = avg
+		}
+		t := float64(j - i)
+		ties += t*t*t - t
+		i = j
+	}
+	return r, ties
+}
+
+// exactULimit bounds n1*n2 for the exact distribution of U.
+const exactULimit = 400
+
+// uCounts returns the number of arrangements of n1 and n2 items for
+// each value of U, for samples without ties.
+func uCounts(n1, n2 int) []float64 {
+	// c[i][j][u]: arrangements of i and j items with statistic u.
+	c := make([][][]float64, n1+1)
+	for i := range c {
+		c[i] = make([][]float64, n2+1)
+		for j := range c[i] {
+			c[i][j] = make([]float64, i*j+1)
+			if i == 0 || j == 0 {
+				c[i][j][0] = 1
+				continue
+			}
+			// The largest item is from the first sample, which
+			// beats all j of the second, or from the second.
+			for u := range c[i][j] {
+				if u >= j {
+					c[i][j][u] += c[i-1][j][u-j]
+				}
+				if u < len(c[i][j-1]) {
+					c[i][j][u] += c[i][j-1][u]
+				}
+			}
+		}
+	}
+	return c[n1][n2]
+}
+
+// mannWhitneyU returns the Mann-Whitney U statistic of a against b,
+// and the two-sided p-value for the hypothesis that both come from
+// the same distribution. Small samples without ties use the exact
+// distribution, others the normal approximation.
+func mannWhitneyU(a, b []float64) (u, p float64) {
+	n1, n2 := float64(len(a)), float64(len(b))
+	r, ties := ranks(append(append([]float64(nil), a...), b...))
+	sum := 0.0
+	for _, x := range r[:len(a)] {
+		sum += x
+	}
+	u = sum - n1*(n1+1)/2
+	mu := n1 * n2 / 2
+
+	if ties == 0 && len(a)*len(b) <= exactULimit {
+		counts := uCounts(len(a), len(b))
+		total := 0.0
+		for _, c := range counts {
+			total += c
+		}
+		// The distribution is symmetric; count the tail
+		// beyond the observed distance from the mean.
+		dist := math.Abs(u - mu)
+		tail := 0.0
+		for k, c := range counts {
+			if math.Abs(float64(k)-mu) >= dist-1e-9 {
+				tail += c
+			}
+		}
+		return u, math.Min(1, tail/total)
+	}
+
+	n := n1 + n2
+	sigma := math.Sqrt(n1 * n2 / 12 * ((n + 1) - ties/(n*(n-1))))
+	if sigma == 0 {
+		return u, 1
+	}
+	z := (math.Abs(u-mu) - 0.5) / sigma
+	return u, math.Min(1, math.Erfc(math.Max(z, 0)/math.Sqrt2))
+}
+
+// comparison is the statistical comparison of a version against the
+// baseline for one measurement.
+type comparison struct {
+	Name       string  `json:"name"`
+	BaseMedian float64 `json:"base_median"`
+	VersMedian float64 `json:"vers_median"`
+
+	// MedianRatio and MeanRatio are version/baseline, with their
+	// bootstrap confidence intervals.
+	MedianRatio float64    `json:"median_ratio"`
+	MedianCI    [2]float64 `json:"median_ci"`
+	MeanRatio   float64    `json:"mean_ratio"`
+	MeanCI      [2]float64 `json:"mean_ci"`
+
+	U float64 `json:"u"`
+	P float64 `json:"p"`
+
+	Confidence float64 `json:"confidence"`
+	Verdict    string  `json:"verdict"`
+}
+
+// compareSamples compares the samples of a version against those of
+// the baseline. The difference is significant if the Mann-Whitney
+// test rejects equality at the confidence level and the median ratio
+// interval excludes 1. An insignificant difference is "neutral" if the
+// interval lies within the tolerance, and otherwise "inconclusive":
+// more runs are needed to tell.
+func compareSamples(name string, base, vers []float64, confidence, tolerance float64) *comparison {
+	rng := rand.New(rand.NewPCG(1, 2))
+	c := &comparison{
+		Name:       name,
+		BaseMedian: median(base),
+		VersMedian: median(vers),
+		Confidence: confidence,
+	}
+	c.MedianRatio = c.VersMedian / c.BaseMedian
+	c.MeanRatio = mean(vers) / mean(base)
+	c.MedianCI[0], c.MedianCI[1] = bootstrapRatioCI(base, vers, median, *bootstrapResamples, confidence, rng)
+	c.MeanCI[0], c.MeanCI[1] = bootstrapRatioCI(base, vers, mean, *bootstrapResamples, confidence, rng)
+	c.U, c.P = mannWhitneyU(vers, base)
+
+	significant := c.P < 1-confidence && (c.MedianCI[0] > 1 || c.MedianCI[1] < 1)
+	switch {
+	case significant && c.MedianRatio > 1 && name == "mem":
+		c.Verdict = "fatter"
+	case significant && name == "mem":
+		c.Verdict = "leaner"
+	case significant && c.MedianRatio > 1:
+		c.Verdict = "slower"
+	case significant:
+		c.Verdict = "faster"
+	case c.MedianCI[0] >= 1-tolerance && c.MedianCI[1] <= 1+tolerance:
+		c.Verdict = "neutral"
+	default:
+		c.Verdict = "inconclusive, need more runs"
+	}
+	return c
+}
+
+// conclusive reports whether the comparison reached a verdict.
+func (c *comparison) conclusive() bool {
+	return c.Verdict != "inconclusive, need more runs"
+}
+
+func (c *comparison) String() string {
+	pct := func(r float64) float64 { return 100 * (r - 1) }
+	return fmt.Sprintf(`    %s median: %f -> %f (%+.2f %%, %g%% CI %+.2f %% .. %+.2f %%)
+    %s mean: %+.2f %% (%g%% CI %+.2f %% .. %+.2f %%)
+    %s Mann-Whitney U=%g p=%.4f: %s`,
+		c.Name, c.BaseMedian, c.VersMedian, pct(c.MedianRatio), 100*c.Confidence, pct(c.MedianCI[0]), pct(c.MedianCI[1]),
+		c.Name, pct(c.MeanRatio), 100*c.Confidence, pct(c.MeanCI[0]), pct(c.MeanCI[1]),
+		c.Name, c.U, c.P, c.Verdict)
+}
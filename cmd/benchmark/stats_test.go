@@ -0,0 +1,76 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	if got := median([]float64{3, 1, 2}); got != 2 {
+		t.Errorf("odd: got %v", got)
+	}
+	if got := median([]float64{4, 1, 3, 2}); got != 2.5 {
+		t.Errorf("even: got %v", got)
+	}
+}
+
+func TestMannWhitneyUExact(t *testing.T) {
+	// With 3 against 3, complete separation is the most extreme
+	// outcome: 2 of the 20 arrangements.
+	u, p := mannWhitneyU([]float64{4, 5, 6}, []float64{1, 2, 3})
+	if u != 9 || math.Abs(p-0.1) > 1e-9 {
+		t.Errorf("got U=%v p=%v, want 9 0.1", u, p)
+	}
+	u, p = mannWhitneyU([]float64{1, 4, 5}, []float64{2, 3, 6})
+	if u != 4 || p != 1 {
+		t.Errorf("got U=%v p=%v, want 4 1", u, p)
+	}
+}
+
+func TestMannWhitneyUApprox(t *testing.T) {
+	var a, b []float64
+	for i := range 30 {
+		a = append(a, float64(i))
+		b = append(b, float64(i)+10)
+	}
+	// Ties force the normal approximation.
+	_, p := mannWhitneyU(a, b)
+	if p > 0.01 {
+		t.Errorf("shifted samples: p=%v", p)
+	}
+	_, p = mannWhitneyU(a, a)
+	if p < 0.9 {
+		t.Errorf("equal samples: p=%v", p)
+	}
+}
+
+func TestUCounts(t *testing.T) {
+	counts := uCounts(2, 2)
+	want := []float64{1, 1, 2, 1, 1}
+	for i := range want {
+		if counts[i] != want[i] {
+			t.Fatalf("got %v, want %v", counts, want)
+		}
+	}
+}
+
+func TestCompareSamples(t *testing.T) {
+	base := []float64{10.0, 10.1, 9.9}
+	slow := []float64{11.0, 11.1, 10.9}
+	if c := compareSamples("time", base, slow, 0.95, 0.01); c.Verdict != "inconclusive, need more runs" {
+		t.Errorf("n=3: got %q", c.Verdict)
+	}
+
+	base = append(base, 10.05, 9.95, 10.02, 9.98, 10.03)
+	slow = append(slow, 11.05, 10.95, 11.02, 10.98, 11.03)
+	c := compareSamples("time", base, slow, 0.95, 0.01)
+	if c.Verdict != "slower" {
+		t.Errorf("n=8: got %q", c.Verdict)
+	}
+	if c.MedianCI[0] > c.MedianRatio || c.MedianCI[1] < c.MedianRatio {
+		t.Errorf("ratio %v outside CI %v", c.MedianRatio, c.MedianCI)
+	}
+	if c := compareSamples("mem", base, base, 0.95, 0.01); c.Verdict != "neutral" {
+		t.Errorf("same samples: got %q", c.Verdict)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// suiteInputs expands the comma separated glob patterns in patterns,
+// and the patterns listed one per line in listFile, to input files.
+// Lines starting with '#' are comments.
+func suiteInputs(patterns, listFile string) ([]string, error) {
+	var pats []string
+	for p := range strings.SplitSeq(patterns, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			pats = append(pats, p)
+		}
+	}
+	if listFile != "" {
+		f, err := os.Open(listFile)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			l := strings.TrimSpace(scanner.Text())
+			if l != "" && !strings.HasPrefix(l, "#") {
+				pats = append(pats, l)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := map[string]bool{}
+	var inputs []string
+	for _, p := range pats {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no inputs match %q", p)
+		}
+		sort.Strings(matches)
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				inputs = append(inputs, m)
+			}
+		}
+	}
+	return inputs, nil
+}
+
+func geomean(fs []float64) float64 {
+	tot := 0.0
+	for _, f := range fs {
+		tot += math.Log(f)
+	}
+	return math.Exp(tot / float64(len(fs)))
+}
+
+// samplePair is the baseline and version samples of one input.
+type samplePair struct {
+	base, vers []float64
+}
+
+// geomeanRatioCI returns the geometric mean over inputs of the ratio
+// of medians, with a bootstrap confidence interval resampling the runs
+// of each input.
+func geomeanRatioCI(pairs []samplePair, resamples int, confidence float64) (ratio, lo, hi float64) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	ratios := make([]float64, len(pairs))
+	for i, p := range pairs {
+		ratios[i] = median(p.vers) / median(p.base)
+	}
+	ratio = geomean(ratios)
+
+	resample := func(src []float64) []float64 {
+		dst := make([]float64, len(src))
+		for i := range dst {
+			dst[i] = src[rng.IntN(len(src))]
+		}
+		return dst
+	}
+	gms := make([]float64, resamples)
+	for k := range gms {
+		for i, p := range pairs {
+			ratios[i] = median(resample(p.vers)) / median(resample(p.base))
+		}
+		gms[k] = geomean(ratios)
+	}
+	sort.Float64s(gms)
+	alpha := 1 - confidence
+	return ratio, percentileSorted(gms, alpha/2), percentileSorted(gms, 1-alpha/2)
+}
+
+// analyzeSuite reports the per-input deltas and the geometric mean
+// over all inputs.
+func analyzeSuite(base, vers string, results []allResults) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "benchmark suite of %d inputs\n\n%s\n", len(results), environment())
+	fmt.Fprintf(&sb, "%s - %s\n    baseline %s - %s\n\n", vers, describe(vers), base, describe(base))
+
+	pct := func(r float64) string { return fmt.Sprintf("%+.2f %%", 100*(r-1)) }
+	tw := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "INPUT\tN\tTIME\tVERDICT\tMEM\tVERDICT")
+	var times, mems []samplePair
+	for _, res := range results {
+		t := analyzeData(res.base.Time, res.vers.Time, "time")
+		m := analyzeData(res.base.Mem, res.vers.Mem, "mem")
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", res.args[len(res.args)-1], res.runCount,
+			pct(t.MedianRatio), t.Verdict, pct(m.MedianRatio), m.Verdict)
+		times = append(times, samplePair{res.base.Time, res.vers.Time})
+		mems = append(mems, samplePair{res.base.Mem, res.vers.Mem})
+	}
+	tw.Flush()
+
+	sb.WriteString("\n")
+	for _, agg := range []struct {
+		name  string
+		pairs []samplePair
+	}{{"time", times}, {"mem", mems}} {
+		r, lo, hi := geomeanRatioCI(agg.pairs, *bootstrapResamples, *confidence)
+		fmt.Fprintf(&sb, "geometric mean %s: %s (%g%% CI %s .. %s)\n", agg.name,
+			pct(r), 100**confidence, pct(lo), pct(hi))
+	}
+	return sb.String()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSuiteInputs(t *testing.T) {
+	dir := t.TempDir()
+	for _, fn := range []string{"a.ly", "b.ly", "c.ly", "d.ily"} {
+		if err := os.WriteFile(filepath.Join(dir, fn), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := filepath.Join(dir, "suite.txt")
+	content := "# comment\n" + filepath.Join(dir, "c.ly") + "\n\n" + filepath.Join(dir, "d.*") + "\n"
+	if err := os.WriteFile(list, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := suiteInputs(filepath.Join(dir, "*.ly")+","+filepath.Join(dir, "a.ly"), list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, fn := range []string{"a.ly", "b.ly", "c.ly", "d.ily"} {
+		want = append(want, filepath.Join(dir, fn))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := suiteInputs(filepath.Join(dir, "*.missing"), ""); err == nil {
+		t.Error("want error for a pattern without matches")
+	}
+}
+
+func TestGeomeanRatioCI(t *testing.T) {
+	pairs := []samplePair{
+		{base: []float64{1, 1, 1}, vers: []float64{2, 2, 2}},
+		{base: []float64{4, 4, 4}, vers: []float64{2, 2, 2}},
+		{base: []float64{3, 3, 3}, vers: []float64{3, 3, 3}},
+	}
+	r, lo, hi := geomeanRatioCI(pairs, 100, 0.95)
+	if math.Abs(r-1) > 1e-9 || math.Abs(lo-1) > 1e-9 || math.Abs(hi-1) > 1e-9 {
+		t.Errorf("got %v (%v .. %v), want 1", r, lo, hi)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+var (
+	worktreeDir    = flag.String("worktrees", "../lilypond-benchmark", "directory for the worktrees, build directories and compiler cache of the benchmarked versions")
+	configureFlags = flag.String("configure_flags", "--disable-documentation CFLAGS=-O2 CXXFLAGS=-O2", "autogen.sh flags for the build directories")
+	makeJobs       = flag.Int("make_jobs", runtime.NumCPU(), "parallel jobs for building")
+	keepWorktrees  = flag.Bool("keep_worktrees", false, "keep the worktrees and build directories after the run, to reuse the builds")
+)
+
+// worktreeRoot returns the absolute path of --worktrees.
+func worktreeRoot() string {
+	dir, err := filepath.Abs(*worktreeDir)
+	check(err)
+	return dir
+}
+
+// Each version v has a detached worktree v/src, and is built in
+// v/build next to it, like the /build layout of gitlab-ci.sh. The
+// relative paths between the two are the same for all versions, so
+// the compiler cache can share objects between them.
+func versionDir(kind, v string) string {
+	return filepath.Join(worktreeRoot(), v, kind)
+}
+
+// lilypondBin returns the lilypond binary of version v.
+func lilypondBin(v string) string {
+	return filepath.Join(versionDir("build", v), "out", "bin", "lilypond")
+}
+
+// ccacheEnv returns the environment to build with ccache, sharing one
+// cache in --worktrees between all versions. Without ccache, each
+// version builds from scratch.
+func ccacheEnv() []string {
+	if _, err := exec.LookPath("ccache"); err != nil {
+		log.Printf("ccache not found; building without a compiler cache")
+		return nil
+	}
+	cc, cxx := os.Getenv("CC"), os.Getenv("CXX")
+	if cc == "" {
+		cc = "gcc"
+	}
+	if cxx == "" {
+		cxx = "g++"
+	}
+	root := worktreeRoot()
+	return []string{
+		"CC=ccache " + cc,
+		"CXX=ccache " + cxx,
+		"CCACHE_DIR=" + filepath.Join(root, "ccache"),
+		// Hash paths relative to the build directory, and leave
+		// the directory itself out, so the versions share
+		// objects.
+		"CCACHE_BASEDIR=" + root,
+		"CCACHE_NOHASHDIR=1",
+	}
+}
+
+// used lists the versions whose worktrees this run used.
+var used []string
+
+// addWorktree creates the worktree of v, unless it exists, and
+// registers it for removeWorktrees.
+func addWorktree(v string) error {
+	if !slices.Contains(used, v) {
+		used = append(used, v)
+	}
+	src := versionDir("src", v)
+	if _, err := os.Stat(src); err == nil {
+		return nil
+	}
+	cmd := exec.Command("git", "worktree", "add", "--detach", src, v)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("worktree add %s: %v", v, err)
+	}
+	return nil
+}
+
+// removeWorktrees removes the worktrees and build directories used by
+// this run, unless --keep_worktrees is set. The compiler cache stays.
+func removeWorktrees() {
+	if *keepWorktrees {
+		return
+	}
+	for _, v := range used {
+		out, err := exec.Command("git", "worktree", "remove", "--force", versionDir("src", v)).CombinedOutput()
+		if err != nil {
+			log.Printf("worktree remove %s: %v\n%s", v, err, out)
+		}
+		if err := os.RemoveAll(filepath.Join(worktreeRoot(), v)); err != nil {
+			log.Printf("removing %s: %v", v, err)
+		}
+	}
+	used = nil
+}
+
+// buildShell runs a shell command of the build, with ccache if it is
+// available.
+func buildShell(env []string, shcmd string) error {
+	cmd := exec.Command("/bin/sh", "-c", shcmd)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// buildVersion builds v in its build directory, unless it was built
+// before in this run, or kept from an earlier one.
+func buildVersion(v string) error {
+	if err := addWorktree(v); err != nil {
+		return err
+	}
+	bin := lilypondBin(v)
+	if _, err := os.Stat(bin); err == nil {
+		log.Printf("using %s", bin)
+		return nil
+	}
+
+	src := versionDir("src", v)
+	build := versionDir("build", v)
+	if err := os.MkdirAll(build, 0755); err != nil {
+		return err
+	}
+	env := ccacheEnv()
+	configMake := filepath.Join(build, "config.make")
+	if _, err := os.Stat(configMake); os.IsNotExist(err) {
+		if err := buildShell(env, fmt.Sprintf("cd %s && %s/autogen.sh %s", build, src, *configureFlags)); err != nil {
+			return err
+		}
+	}
+	if content, err := os.ReadFile(configMake); err != nil {
+		return err
+	} else if !strings.Contains(string(content), "-O2") {
+		return fmt.Errorf("%s is missing -O2", configMake)
+	}
+	return buildShell(env, fmt.Sprintf("make -C %s -j%d", build, *makeJobs))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCcacheEnv(t *testing.T) {
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "ccache"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	t.Setenv("CC", "clang")
+	t.Setenv("CXX", "")
+	defer func(old string) { *worktreeDir = old }(*worktreeDir)
+	*worktreeDir = "/work"
+
+	env := ccacheEnv()
+	for _, want := range []string{"CC=ccache clang", "CXX=ccache g++", "CCACHE_DIR=/work/ccache", "CCACHE_BASEDIR=/work"} {
+		if !slices.Contains(env, want) {
+			t.Errorf("missing %s in %v", want, env)
+		}
+	}
+
+	// The source is at the same relative path from every build
+	// directory, so the cache is shared.
+	rel := func(v string) string {
+		r, err := filepath.Rel(versionDir("build", v), versionDir("src", v))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if a, b := rel("abc1234"), rel("def5678"); a != b {
+		t.Errorf("relative source paths differ: %s, %s", a, b)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	if env := ccacheEnv(); env != nil {
+		t.Errorf("without ccache: got %v", env)
+	}
+}
+
+func TestRemoveWorktrees(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	git := func(args ...string) string {
+		out, err := exec.Command("git", append([]string{"-C", repo, "-c", "user.name=t", "-c", "user.email=t@localhost"}, args...)...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("init", "-q")
+	git("commit", "-q", "--allow-empty", "-m", "first")
+	v := git("rev-parse", "--short", "HEAD")
+
+	t.Chdir(repo)
+	defer func(old string) { *worktreeDir = old }(*worktreeDir)
+	*worktreeDir = filepath.Join(t.TempDir(), "worktrees")
+	used = nil
+
+	for range 2 {
+		if err := addWorktree(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(used) != 1 {
+		t.Errorf("used %v, want one entry", used)
+	}
+	if _, err := os.Stat(versionDir("src", v)); err != nil {
+		t.Fatal(err)
+	}
+
+	removeWorktrees()
+	if _, err := os.Stat(filepath.Join(*worktreeDir, v)); !os.IsNotExist(err) {
+		t.Errorf("version directory still there: %v", err)
+	}
+	if out := git("worktree", "list"); strings.Contains(out, *worktreeDir) {
+		t.Errorf("worktree still registered:\n%s", out)
+	}
+}
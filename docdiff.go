@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// The doc stage copies the offline manual (out-www/offline-root) to
+// docDir. Differences against the last master doc run go to
+// docDiffDir.
+const (
+	docDir     = "doc"
+	docDiffDir = "doc-diff"
+)
+
+var (
+	compareTool = flag.String("compare", "go run ./cmd/compare", "command to compare changed doc images")
+	pdfTextTool = flag.String("pdftotext", "pdftotext -q -enc UTF-8", "command to extract the text of changed PDF manuals; the file and - are appended")
+	upstreamURL = flag.String("upstream", "https://gitlab.com/lilypond/lilypond.git", "URL of the official repository, whose master doc runs are the baseline of doc diffs")
+)
+
+// docDiff is the difference between two manuals.
+type docDiff struct {
+	Added   []string
+	Removed []string
+	// Changed maps a page to the text lines removed ("-") and added
+	// ("+").
+	Changed map[string][]string
+	// Images are the images that differ.
+	Images []string
+}
+
+var (
+	htmlSkipRe  = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlBlockRe = regexp.MustCompile(`(?i)</?(p|div|br|li|dt|dd|h[1-6]|tr|td|th|pre|table|blockquote)\b[^>]*>`)
+	htmlTagRe   = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// htmlText returns the text lines of an HTML page, without markup and
+// blank lines. Block elements start a new line.
+func htmlText(content []byte) []string {
+	s := htmlSkipRe.ReplaceAllString(string(content), "")
+	s = htmlBlockRe.ReplaceAllString(s, "\n")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+
+	var lines []string
+	for l := range strings.SplitSeq(s, "\n") {
+		if l = strings.Join(strings.Fields(l), " "); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// diffLines returns the lines of a missing from b ("-"), and of b
+// missing from a ("+"), counting duplicates. The order of the pages
+// is kept, but moved lines are not reported.
+func diffLines(a, b []string) []string {
+	count := map[string]int{}
+	for _, l := range a {
+		count[l]++
+	}
+	for _, l := range b {
+		count[l]--
+	}
+
+	var result []string
+	for _, l := range a {
+		if count[l] > 0 {
+			count[l]--
+			result = append(result, "-"+l)
+		}
+	}
+	for _, l := range b {
+		if count[l] < 0 {
+			count[l]++
+			result = append(result, "+"+l)
+		}
+	}
+	return result
+}
+
+// pdfText returns the text lines of a PDF file, without blank lines.
+func pdfText(fn string) ([]string, error) {
+	args := append(strings.Fields(*pdfTextTool), fn, "-")
+	out, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", args, err)
+	}
+	var lines []string
+	for l := range strings.SplitSeq(string(out), "\n") {
+		if l = strings.Join(strings.Fields(l), " "); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// diffPDF compares the text of two PDF files. Without the text tool,
+// it reports that the files differ.
+func diffPDF(old, new string) ([]string, error) {
+	a, err := pdfText(old)
+	if errors.Is(err, exec.ErrNotFound) {
+		return []string{"(text not compared: " + err.Error() + ")"}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	b, err := pdfText(new)
+	if err != nil {
+		return nil, err
+	}
+	return diffLines(a, b), nil
+}
+
+// docFiles returns the regular files under dir, relative to dir.
+func docFiles(dir string) (map[string]bool, error) {
+	files := map[string]bool{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		files[rel] = true
+		return nil
+	})
+	return files, err
+}
+
+// isPage reports whether fn is a page of the manual, rather than an
+// image or support file.
+func isPage(fn string) bool {
+	switch filepath.Ext(fn) {
+	case ".html", ".pdf":
+		return true
+	}
+	return false
+}
+
+// diffDocs compares the manuals in the directories old and new.
+func diffDocs(old, new string) (*docDiff, error) {
+	oldFiles, err := docFiles(old)
+	if err != nil {
+		return nil, err
+	}
+	newFiles, err := docFiles(new)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &docDiff{Changed: map[string][]string{}}
+	for fn := range newFiles {
+		if !oldFiles[fn] && isPage(fn) {
+			d.Added = append(d.Added, fn)
+		}
+	}
+	for fn := range oldFiles {
+		if !newFiles[fn] {
+			if isPage(fn) {
+				d.Removed = append(d.Removed, fn)
+			}
+			continue
+		}
+
+		ext := filepath.Ext(fn)
+		if ext != ".html" && ext != ".pdf" && ext != ".png" {
+			continue
+		}
+		a, err := os.ReadFile(filepath.Join(old, fn))
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(filepath.Join(new, fn))
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(a, b) {
+			continue
+		}
+		var lines []string
+		switch ext {
+		case ".png":
+			d.Images = append(d.Images, fn)
+		case ".pdf":
+			// PDFs embed their creation time, so they always
+			// differ bytewise.
+			if lines, err = diffPDF(filepath.Join(old, fn), filepath.Join(new, fn)); err != nil {
+				return nil, err
+			}
+		default:
+			lines = diffLines(htmlText(a), htmlText(b))
+		}
+		if len(lines) > 0 {
+			d.Changed[fn] = lines
+		}
+	}
+	sort.Strings(d.Added)
+	sort.Strings(d.Removed)
+	sort.Strings(d.Images)
+	return d, nil
+}
+
+// maxChangedLines limits the lines shown per changed page.
+const maxChangedLines = 20
+
+// write prints a summary of the difference.
+func (d *docDiff) write(w io.Writer) error {
+	var pages []string
+	for p := range d.Changed {
+		pages = append(pages, p)
+	}
+	sort.Strings(pages)
+
+	for _, p := range d.Added {
+		fmt.Fprintf(w, "added %s\n", p)
+	}
+	for _, p := range d.Removed {
+		fmt.Fprintf(w, "removed %s\n", p)
+	}
+	for _, p := range pages {
+		lines := d.Changed[p]
+		fmt.Fprintf(w, "changed %s (%d lines)\n", p, len(lines))
+		if len(lines) > maxChangedLines {
+			lines = lines[:maxChangedLines]
+		}
+		for _, l := range lines {
+			fmt.Fprintf(w, "    %s\n", l)
+		}
+	}
+	for _, p := range d.Images {
+		fmt.Fprintf(w, "image %s\n", p)
+	}
+	_, err := fmt.Fprintf(w, "%d added, %d removed, %d changed pages, %d changed images\n",
+		len(d.Added), len(d.Removed), len(pages), len(d.Images))
+	return err
+}
+
+// compareImages links the changed images of old and new into flat
+// directories under out, and runs the image compare tool on them.
+func (d *docDiff) compareImages(old, new, out string) error {
+	var dirs []string
+	for i, src := range []string{old, new} {
+		dir := filepath.Join(out, fmt.Sprintf("images.%d", i))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		for _, fn := range d.Images {
+			flat := strings.ReplaceAll(fn, string(filepath.Separator), "_")
+			if err := os.Link(filepath.Join(src, fn), filepath.Join(dir, flat)); err != nil {
+				return err
+			}
+		}
+		dirs = append(dirs, dir)
+	}
+
+	args := strings.Fields(*compareTool)
+	args = append(args, `--file_regexp=\.png$`, dirs[0], dirs[1], filepath.Join(out, "images"))
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Printf("running: %v", cmd.Args)
+	return cmd.Run()
+}
+
+// normalizeURL strips the parts of a repository URL that do not
+// change the repository.
+func normalizeURL(url string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+}
+
+// masterURLs returns the repository URLs whose master is the official
+// one: the lilypond checkout, its origin, and --upstream.
+func masterURLs() map[string]bool {
+	urls := map[string]bool{"lilypond": true, normalizeURL(*upstreamURL): true}
+	if origin, err := gitIn("lilypond", "remote", "get-url", "origin"); err == nil {
+		urls[normalizeURL(origin)] = true
+	}
+	return urls
+}
+
+// lastMasterDoc returns the run directory of the latest successful
+// doc run of master for the platform, or "" if there is none. Runs of
+// a master from other URLs, such as forks, do not count.
+func lastMasterDoc(root, platform string, urls map[string]bool) (string, error) {
+	entries, err := readIndex(root)
+	if err != nil {
+		return "", err
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		if e.Branch != "master" || e.Stage != "doc" || e.Status != "ok" || e.Platform != platform {
+			continue
+		}
+		if !urls[normalizeURL(e.URL)] {
+			continue
+		}
+		dir := filepath.Join(root, e.Dir)
+		if _, err := os.Stat(filepath.Join(dir, docDir)); err == nil {
+			return dir, nil
+		}
+	}
+	return "", nil
+}
+
+// writeDocDiff compares the manual of the run in dir with the one of
+// the run in baseline, and writes the result to docDiffDir in dir.
+func writeDocDiff(dir, baseline string) error {
+	old := filepath.Join(baseline, docDir)
+	new := filepath.Join(dir, docDir)
+	d, err := diffDocs(old, new)
+	if err != nil {
+		return err
+	}
+
+	out := filepath.Join(dir, docDiffDir)
+	if err := os.RemoveAll(out); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(out, 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(out, "summary.txt"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(f, "baseline %s\n", baseline)
+	if err := d.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("doc diff against %s: %d added, %d removed, %d changed pages, %d changed images",
+		baseline, len(d.Added), len(d.Removed), len(d.Changed), len(d.Images))
+
+	if len(d.Images) > 0 {
+		return d.compareImages(old, new, out)
+	}
+	return nil
+}
+
+// diffMasterDoc compares the manual of the doc run in dir against the
+// last master doc run. Errors are logged, as the diff is informative.
+func diffMasterDoc(root, dir, platform string) {
+	baseline, err := lastMasterDoc(root, platform, masterURLs())
+	if err != nil {
+		log.Printf("lastMasterDoc: %v", err)
+		return
+	}
+	if baseline == "" {
+		log.Printf("no master doc run for %s to compare with", platform)
+		return
+	}
+	if err := writeDocDiff(dir, baseline); err != nil {
+		log.Printf("writeDocDiff: %v", err)
+	}
+}
+
+// docDiffCommand compares the manuals of two doc runs.
+func docDiffCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: docdiff BASELINE-DIR DIR")
+	}
+	return writeDocDiff(args[1], args[0])
+}
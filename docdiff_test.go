@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHTMLText(t *testing.T) {
+	got := htmlText([]byte(`<html><head><style>p { }</style></head>
+<body><p>Beams &amp; slurs</p>
+
+<script>var x = 1;</script>
+<p>  spaced
+   out </p></body></html>`))
+	want := []string{"Beams & slurs", "spaced", "out"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestDiffDocs(t *testing.T) {
+	dir := t.TempDir()
+	trees := map[string]map[string]string{
+		"old": {
+			"Documentation/notation/beams.html": "<p>Beams</p><p>are nice</p>",
+			"Documentation/notation/slurs.html": "<p>Slurs</p>",
+			"Documentation/notation/ties.html":  "<p>Ties</p>",
+			"Documentation/ab/lily-1234.png":    "old image",
+			"Documentation/ab/lily-5678.png":    "same image",
+		},
+		"new": {
+			"Documentation/notation/beams.html": "<p>Beams</p>\n<p>are great</p>",
+			"Documentation/notation/slurs.html": "<div><p>Slurs</p></div>",
+			"Documentation/notation/cues.html":  "<p>Cues</p>",
+			"Documentation/ab/lily-1234.png":    "new image",
+			"Documentation/ab/lily-5678.png":    "same image",
+		},
+	}
+	for tree, files := range trees {
+		for name, content := range files {
+			fn := filepath.Join(dir, tree, name)
+			if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	d, err := diffDocs(filepath.Join(dir, "old"), filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("diffDocs: %v", err)
+	}
+	want := &docDiff{
+		Added:   []string{"Documentation/notation/cues.html"},
+		Removed: []string{"Documentation/notation/ties.html"},
+		Changed: map[string][]string{
+			"Documentation/notation/beams.html": {"-are nice", "+are great"},
+		},
+		Images: []string{"Documentation/ab/lily-1234.png"},
+	}
+	if !reflect.DeepEqual(d, want) {
+		t.Errorf("got %+v, want %+v", d, want)
+	}
+}
+
+func TestDiffDocsPDF(t *testing.T) {
+	dir := t.TempDir()
+	// A stand-in for pdftotext that prints the file.
+	tool := filepath.Join(dir, "pdftotext")
+	if err := os.WriteFile(tool, []byte("#!/bin/sh\ncat \"$1\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer func(old string) { *pdfTextTool = old }(*pdfTextTool)
+	*pdfTextTool = tool
+
+	for tree, content := range map[string]string{"old": "Notation\nBeams are nice\n", "new": "Notation\nBeams are great\n"} {
+		fn := filepath.Join(dir, tree, "Documentation", "notation.pdf")
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := diffDocs(filepath.Join(dir, "old"), filepath.Join(dir, "new"))
+	if err != nil {
+		t.Fatalf("diffDocs: %v", err)
+	}
+	want := map[string][]string{"Documentation/notation.pdf": {"-Beams are nice", "+Beams are great"}}
+	if !reflect.DeepEqual(d.Changed, want) {
+		t.Errorf("got %v, want %v", d.Changed, want)
+	}
+}
+
+func TestLastMasterDoc(t *testing.T) {
+	root := t.TempDir()
+	t0 := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	var entries []*indexEntry
+	for i, e := range []*indexEntry{
+		{Dir: "upstream/doc/lilypond-base-fedora33/1111", URL: "https://gitlab.com/lilypond/lilypond.git"},
+		{Dir: "local/doc/lilypond-base-fedora33/2222", URL: "lilypond"},
+		{Dir: "fork/doc/lilypond-base-fedora33/3333", URL: "https://github.com/someone/lilypond"},
+	} {
+		e.Branch, e.Stage, e.Status, e.Platform = "master", "doc", "ok", "fedora33"
+		e.Start = t0.Add(time.Duration(i) * time.Hour)
+		if err := os.MkdirAll(filepath.Join(root, e.Dir, docDir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if err := appendIndex(root, entries...); err != nil {
+		t.Fatal(err)
+	}
+
+	urls := map[string]bool{"lilypond": true}
+	if got, err := lastMasterDoc(root, "fedora33", urls); err != nil || got != filepath.Join(root, entries[1].Dir) {
+		t.Errorf("got %q, %v, want the local run", got, err)
+	}
+	urls = map[string]bool{normalizeURL("https://gitlab.com/lilypond/lilypond/"): true}
+	if got, err := lastMasterDoc(root, "fedora33", urls); err != nil || got != filepath.Join(root, entries[0].Dir) {
+		t.Errorf("got %q, %v, want the upstream run", got, err)
+	}
+	if got, err := lastMasterDoc(root, "ubuntu20", urls); err != nil || got != "" {
+		t.Errorf("other platform: got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"text/template"
+)
+
+// dockerfileParams are the per-platform parameters for a dockerfile
+// template.
+type dockerfileParams struct {
+	// BaseImage is the distribution image to start from.
+	BaseImage string
+	// Packages are installed in addition to the GUILE packages.
+	Packages []string
+	// Guile is the GUILE version, e.g. "1.8" or "2.2".
+	Guile string
+	// GuileSource, if set, is a GUILE release to build from
+	// source, for distributions without a package.
+	GuileSource string
+}
+
+type platformSetting struct {
+	Dockerfile string
+	// Template generates Dockerfile from Params. If empty, the
+	// dockerfile is maintained by hand.
+	Template string
+	Params   dockerfileParams
+}
+
+var fedoraPackages = []string{
+	"ImageMagick",
+	"autoconf",
+	"automake",
+	"bison",
+	"cairo",
+	"cairo-devel",
+	"ccache",
+	"curl",
+	"dblatex",
+	"dejavu-'*'",
+	"diffutils",
+	"extractpdfmark",
+	"flex",
+	"fontforge",
+	"fontpackages-devel",
+	"gcc-c++",
+	"gdb",
+	"gettext",
+	"ghostscript",
+	"git-core",
+	"libgs-devel",
+	"make",
+	"pango-devel",
+	"perl-Math-Complex",
+	"perl-Pod-Parser",
+	"rsync",
+	"t1utils",
+	"texi2html",
+	"texinfo",
+	"texinfo-tex",
+	"texlive-lh",
+	"texlive-metapost",
+	"texlive-tetex",
+	"texlive-tex-gyre",
+	"time",
+}
+
+var platformSettings = map[string]platformSetting{
+	"ubuntu16": {
+		Dockerfile: "ubuntu-xenial.dockerfile",
+		Template:   "ubuntu.dockerfile.tmpl",
+		Params: dockerfileParams{
+			BaseImage: "ubuntu:16.04",
+			Guile:     "1.8",
+			Packages: []string{
+				"apt-transport-https",
+				"autoconf",
+				"autotools-dev",
+				"bison",
+				"ca-certificates",
+				"ccache",
+				"dblatex",
+				"debhelper",
+				"flex",
+				"fontforge",
+				"fonts-dejavu",
+				"fonts-freefont-ttf",
+				"fonts-ipafont-gothic",
+				"fonts-ipafont-mincho",
+				"fonts-texgyre",
+				"g++",
+				"gdb",
+				"gettext",
+				"ghostscript",
+				"git",
+				"groff",
+				"gsfonts",
+				"gsfonts-x11",
+				"help2man",
+				"imagemagick",
+				"less",
+				"libfl-dev",
+				"libfontconfig1-dev",
+				"libfreetype6-dev",
+				"libgmp3-dev",
+				"libgs-dev",
+				"libltdl-dev",
+				"libpango1.0-dev",
+				"libpangoft2-1.0-0",
+				"lmodern",
+				"m4",
+				"make",
+				"moreutils",
+				"nano",
+				"netpbm",
+				"pkg-config",
+				"python-all",
+				"python3.5",
+				"rsync",
+				"texi2html",
+				"texinfo",
+				"texlive-fonts-recommended",
+				"texlive-generic-recommended",
+				"texlive-lang-cyrillic",
+				"texlive-latex-base",
+				"texlive-latex-recommended",
+				"texlive-metapost",
+				"texlive-xetex",
+				"time",
+				"zip",
+			},
+		},
+	},
+	"ubuntu18": {
+		Dockerfile: "ubuntu-beaver.dockerfile",
+		Template:   "ubuntu.dockerfile.tmpl",
+		Params: dockerfileParams{
+			BaseImage:   "ubuntu:18.04",
+			Guile:       "1.8",
+			GuileSource: "1.8.8",
+			Packages: []string{
+				"autoconf",
+				"bison",
+				"ca-certificates",
+				"ccache",
+				"flex",
+				"fontconfig",
+				"fontforge",
+				"fonts-texgyre",
+				"g++",
+				"gettext",
+				"ghostscript",
+				"git",
+				"imagemagick",
+				"libcairo-dev",
+				"libfl-dev",
+				"libfontconfig1-dev",
+				"libfreetype6-dev",
+				"libglib2.0-dev",
+				"libgmp-dev",
+				"libgs-dev",
+				"libltdl-dev",
+				"libpango1.0-dev",
+				"make",
+				"perl",
+				"pkg-config",
+				"python3",
+				"rsync",
+				"texi2html",
+				"texinfo",
+				"texlive-binaries",
+				"texlive-fonts-recommended",
+				"texlive-lang-cyrillic",
+				"texlive-latex-base",
+				"texlive-latex-recommended",
+				"texlive-metapost",
+				"texlive-plain-generic",
+				"texlive-xetex",
+				"wget",
+				"zip",
+			},
+		},
+	},
+	"fedora31": {
+		Dockerfile: "fedora-31.dockerfile",
+		Template:   "fedora.dockerfile.tmpl",
+		Params: dockerfileParams{
+			BaseImage: "fedora:31",
+			Guile:     "1.8",
+			Packages:  fedoraPackages,
+		},
+	},
+	"fedora33": {
+		Dockerfile: "fedora-33.dockerfile",
+		Template:   "fedora.dockerfile.tmpl",
+		Params: dockerfileParams{
+			BaseImage: "fedora:33",
+			Guile:     "1.8",
+			Packages:  fedoraPackages,
+		},
+	},
+	releasePlatform: {
+		Dockerfile: "ubuntu-2204-binary-release.dockerfile",
+	},
+	"fedora31-guile2": {
+		Dockerfile: "fedora-31-guile2.dockerfile",
+		Template:   "fedora.dockerfile.tmpl",
+		Params: dockerfileParams{
+			BaseImage: "fedora:31",
+			Guile:     "2.2",
+			Packages:  fedoraPackages,
+		},
+	},
+}
+
+// guilePackages lists the GUILE packages by template and GUILE
+// version.
+var guilePackages = map[string]map[string][]string{
+	"fedora.dockerfile.tmpl": {
+		"1.8": {"compat-guile18-devel"},
+		"2.2": {"guile22", "guile22-devel"},
+	},
+	"ubuntu.dockerfile.tmpl": {
+		"1.8": {"guile-1.8", "guile-1.8-dev"},
+	},
+}
+
+// generateDockerfile expands the template for the platform.
+func generateDockerfile(s platformSetting) ([]byte, error) {
+	t, err := template.ParseFiles(s.Template)
+	if err != nil {
+		return nil, err
+	}
+
+	data := struct {
+		dockerfileParams
+		// GuileBinary is linked to /usr/bin/guile, if set.
+		GuileBinary string
+	}{dockerfileParams: s.Params}
+
+	packages := slices.Clone(s.Params.Packages)
+	if s.Params.GuileSource == "" {
+		guile, ok := guilePackages[s.Template][s.Params.Guile]
+		if !ok {
+			return nil, fmt.Errorf("%s: no packages for GUILE %s", s.Template, s.Params.Guile)
+		}
+		packages = append(packages, guile...)
+		if s.Params.Guile != "1.8" {
+			data.GuileBinary = "guile" + s.Params.Guile
+		}
+	}
+	slices.Sort(packages)
+	data.Packages = slices.Compact(packages)
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, &data); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// staleDockerfiles returns the dockerfiles that differ from their
+// generated content.
+func staleDockerfiles() ([]string, error) {
+	var stale []string
+	for _, p := range allPlatforms {
+		s := platformSettings[p]
+		want, err := generateDockerfile(s)
+		if err != nil {
+			return nil, err
+		}
+		got, err := os.ReadFile(s.Dockerfile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if !bytes.Equal(got, want) {
+			stale = append(stale, s.Dockerfile)
+		}
+	}
+	return stale, nil
+}
+
+// generateCommand writes the dockerfiles for all platforms from their
+// templates. With "check", it only reports the dockerfiles that are
+// out of date.
+//
+//	generate [check]
+func generateCommand(args []string) error {
+	if len(args) == 1 && args[0] == "check" {
+		stale, err := staleDockerfiles()
+		if err != nil {
+			return err
+		}
+		if len(stale) > 0 {
+			return fmt.Errorf("out of date, run 'go run . generate': %v", stale)
+		}
+		return nil
+	} else if len(args) > 0 {
+		return fmt.Errorf("usage: generate [check]")
+	}
+
+	for _, p := range allPlatforms {
+		s := platformSettings[p]
+		content, err := generateDockerfile(s)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		if err := os.WriteFile(s.Dockerfile, content, 0644); err != nil {
+			return err
+		}
+		log.Printf("wrote %s", s.Dockerfile)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package main
+
+import "testing"
+
+func TestDockerfilesUpToDate(t *testing.T) {
+	stale, err := staleDockerfiles()
+	if err != nil {
+		t.Fatalf("staleDockerfiles: %v", err)
+	}
+	if len(stale) > 0 {
+		t.Errorf("dockerfiles differ from their templates, run 'go run . generate': %v", stale)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+)
+
+// Duration estimates use the last estimateRuns successful runs, and
+// need at least estimateMinRuns of them.
+const (
+	estimateRuns    = 50
+	estimateMinRuns = 3
+)
+
+// durationEstimate is the expected duration of a run, from the runs
+// of the same platform, mode and stage.
+type durationEstimate struct {
+	Runs int
+	P50  time.Duration
+	P95  time.Duration
+}
+
+func (d *durationEstimate) String() string {
+	return fmt.Sprintf("%v (p95 %v, from %d runs)", d.P50.Round(time.Minute), d.P95.Round(time.Minute), d.Runs)
+}
+
+// percentile returns the p-th percentile of sorted ds, by nearest
+// rank.
+func percentile(ds []time.Duration, p int) time.Duration {
+	i := (len(ds)*p + 99) / 100
+	return ds[max(i-1, 0)]
+}
+
+// estimateDuration estimates the duration of a run from entries, as
+// returned by readIndex. Failed runs are left out, as they often stop
+// early. It returns nil if there is not enough history.
+func estimateDuration(entries []*indexEntry, platform, mode, stage string) *durationEstimate {
+	var ds []time.Duration
+	for i := len(entries) - 1; i >= 0 && len(ds) < estimateRuns; i-- {
+		e := entries[i]
+		if e.Platform != platform || e.Mode != mode || e.Stage != stage || e.Status != "ok" {
+			continue
+		}
+		if d := e.Duration(); d > 0 {
+			ds = append(ds, d)
+		}
+	}
+	if len(ds) < estimateMinRuns {
+		return nil
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	return &durationEstimate{
+		Runs: len(ds),
+		P50:  percentile(ds, 50),
+		P95:  percentile(ds, 95),
+	}
+}
+
+// estimates caches duration estimates for one read of the index.
+type estimates struct {
+	entries []*indexEntry
+	cache   map[[3]string]*durationEstimate
+}
+
+// newEstimates reads the index of the results tree at root.
+func newEstimates(root string) (*estimates, error) {
+	entries, err := readIndex(root)
+	if err != nil {
+		return nil, err
+	}
+	return &estimates{
+		entries: entries,
+		cache:   map[[3]string]*durationEstimate{},
+	}, nil
+}
+
+func (e *estimates) get(platform, mode, stage string) *durationEstimate {
+	k := [3]string{platform, mode, stage}
+	d, ok := e.cache[k]
+	if !ok {
+		d = estimateDuration(e.entries, platform, mode, stage)
+		e.cache[k] = d
+	}
+	return d
+}
+
+// watchDuration prints the estimated end of a run started at start to
+// w, and a warning once the run takes longer than the p95 of its
+// history. It returns a function to stop watching.
+func watchDuration(d *durationEstimate, start time.Time, w io.Writer) func() {
+	msg := fmt.Sprintf("estimated duration %v, ETA %s", d, start.Add(d.P50).Format("15:04"))
+	log.Print(msg)
+	fmt.Fprintln(w, msg)
+	t := time.AfterFunc(time.Until(start.Add(d.P95)), func() {
+		msg := fmt.Sprintf("run is suspicious: running longer than the p95 of %v", d.P95.Round(time.Minute))
+		log.Print(msg)
+		fmt.Fprintln(w, msg)
+	})
+	return func() { t.Stop() }
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEstimateDuration(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var entries []*indexEntry
+	add := func(platform, status string, minutes int) {
+		entries = append(entries, &indexEntry{
+			Platform: platform,
+			Mode:     "full",
+			Stage:    "doc",
+			Status:   status,
+			Start:    start,
+			End:      start.Add(time.Duration(minutes) * time.Minute),
+		})
+	}
+	add("fedora33", "ok", 40)
+	add("fedora33", "ok", 60)
+	if d := estimateDuration(entries, "fedora33", "full", "doc"); d != nil {
+		t.Errorf("got estimate %v from 2 runs", d)
+	}
+
+	for _, m := range []int{50, 45, 55, 240} {
+		add("fedora33", "ok", m)
+	}
+	add("fedora33", "failed", 1)
+	add("ubuntu18", "ok", 10)
+
+	d := estimateDuration(entries, "fedora33", "full", "doc")
+	if d == nil {
+		t.Fatal("no estimate")
+	}
+	if d.Runs != 6 || d.P50 != 50*time.Minute || d.P95 != 240*time.Minute {
+		t.Errorf("got %+v", d)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	ds := []time.Duration{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for p, want := range map[int]time.Duration{0: 1, 50: 5, 95: 10, 100: 10} {
+		if got := percentile(ds, p); got != want {
+			t.Errorf("percentile %d: got %v, want %v", p, got, want)
+		}
+	}
+}
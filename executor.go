@@ -0,0 +1,186 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sync"
+)
+
+var (
+	executorsFile = flag.String("executors", "", "JSON file with executor definitions")
+	executorName  = flag.String("executor", "local", "executor to run tests on, or 'auto' to pick one by platform")
+)
+
+// executor is a machine that runs test containers. Remote executors
+// are reached over SSH: the lilypond repository and driver scripts are
+// copied with rsync, containers run through "docker -H ssh://HOST",
+// and the results are copied back.
+type executor struct {
+	Name string `json:"name"`
+	// Host is the SSH destination, e.g. "ci@buildbox". Empty for
+	// the local machine.
+	Host string `json:"host"`
+	// MaxJobs is the number of tests run concurrently.
+	MaxJobs int `json:"max_jobs"`
+	// Platforms lists the platforms with images on the host. If
+	// empty, all are supported.
+	Platforms []string `json:"platforms"`
+	// Dir is the directory on the host for the repository copy
+	// and results.
+	Dir string `json:"dir"`
+
+	running int
+}
+
+func (e *executor) dockerHost() string {
+	if e.Host == "" {
+		return ""
+	}
+	return "ssh://" + e.Host
+}
+
+func (e *executor) supports(platform string) bool {
+	return len(e.Platforms) == 0 || known(e.Platforms, platform)
+}
+
+// sync copies the lilypond repository, the driver scripts and the
+// smoke test inputs to the host.
+func (e *executor) sync() error {
+	return system(fmt.Sprintf(`ssh %[1]s mkdir -p %[2]s/lilypond %[2]s/results
+rsync -a --delete lilypond/.git/ %[1]s:%[2]s/lilypond/.git/
+rsync -a *.sh compare-testdata %[1]s:%[2]s/`, e.Host, e.Dir))
+}
+
+// jobReposDir holds the copies of the repository for running jobs,
+// next to the lilypond checkout.
+const jobReposDir = "job-repos"
+
+// onHost runs the shell command cmd on host, or locally if host is
+// empty.
+func onHost(host, cmd string) error {
+	if host != "" {
+		cmd = fmt.Sprintf("ssh %s '%s'", host, cmd)
+	}
+	return system(cmd)
+}
+
+// copyRepo makes dst a copy of the git repository of the checkout src,
+// on host. The files are hard linked. Git replaces the objects, refs
+// and index rather than changing them, so updates of src leave the
+// copy alone; only reflogs and FETCH_HEAD, which runs do not read, are
+// changed in place.
+func copyRepo(host, src, dst string) error {
+	return onHost(host, fmt.Sprintf("rm -rf %[2]s && mkdir -p %[2]s && cp -al %[1]s/.git %[2]s/.git", src, dst))
+}
+
+// removeRepo removes a copy made by copyRepo.
+func removeRepo(host, dst string) error {
+	return onHost(host, "rm -rf "+dst)
+}
+
+// fetchResults copies the results in remote on the host to local, and
+// removes them from the host.
+func (e *executor) fetchResults(remote, local string) error {
+	if err := system(fmt.Sprintf("rsync -a %s:%s/ %s/", e.Host, remote, local)); err != nil {
+		return err
+	}
+	if err := system(fmt.Sprintf("ssh %s rm -rf %s", e.Host, remote)); err != nil {
+		log.Printf("removing %s on %s: %v", remote, e.Host, err)
+	}
+	return nil
+}
+
+// loadExecutors reads executor definitions from a JSON file. Unless
+// the file defines it, a "local" executor running one job is added.
+func loadExecutors(fn string) ([]*executor, error) {
+	var executors []*executor
+	if fn != "" {
+		if err := readJSON(fn, &executors); err != nil {
+			return nil, err
+		}
+	}
+	hasLocal := false
+	for _, e := range executors {
+		if e.Name == "" {
+			return nil, fmt.Errorf("%s: executor without name", fn)
+		}
+		if e.Host != "" && e.Dir == "" {
+			return nil, fmt.Errorf("%s: executor %s needs dir", fn, e.Name)
+		}
+		for _, p := range e.Platforms {
+			if !knownPlatform(p) {
+				return nil, fmt.Errorf("%s: executor %s: unknown platform %q", fn, e.Name, p)
+			}
+		}
+		if e.MaxJobs == 0 {
+			e.MaxJobs = 1
+		}
+		hasLocal = hasLocal || e.Name == "local"
+	}
+	if !hasLocal {
+		executors = append(executors, &executor{Name: "local", MaxJobs: 1})
+	}
+	return executors, nil
+}
+
+// executorPool hands out executor slots.
+type executorPool struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	executors []*executor
+}
+
+func newExecutorPool(executors []*executor) *executorPool {
+	p := &executorPool{executors: executors}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// slots returns the total number of jobs the pool can run.
+func (p *executorPool) slots() int {
+	n := 0
+	for _, e := range p.executors {
+		n += e.MaxJobs
+	}
+	return n
+}
+
+// acquire waits for a free slot on an executor supporting the platform.
+// If name is not "auto", only that executor is used. Among the
+// candidates, the least loaded one is picked.
+func (p *executorPool) acquire(name, platform string) (*executor, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var candidates []*executor
+	for _, e := range p.executors {
+		if (name == "auto" || name == e.Name) && e.supports(platform) {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no executor %q for platform %s", name, platform)
+	}
+
+	for {
+		var best *executor
+		for _, e := range candidates {
+			if e.running < e.MaxJobs && (best == nil || e.running*best.MaxJobs < best.running*e.MaxJobs) {
+				best = e
+			}
+		}
+		if best != nil {
+			best.running++
+			return best, nil
+		}
+		p.cond.Wait()
+	}
+}
+
+func (p *executorPool) release(e *executor) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	e.running--
+	p.cond.Broadcast()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestExecutorPool(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "executors.json")
+	if err := writeJSON(fn, []*executor{
+		{Name: "big", Host: "ci@big", Dir: "/ci", MaxJobs: 2, Platforms: []string{"fedora33"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	executors, err := loadExecutors(fn)
+	if err != nil {
+		t.Fatalf("loadExecutors: %v", err)
+	}
+	if len(executors) != 2 || executors[1].Name != "local" {
+		t.Fatalf("got %v, want big and local", executors)
+	}
+
+	pool := newExecutorPool(executors)
+	if got := pool.slots(); got != 3 {
+		t.Errorf("slots: got %d, want 3", got)
+	}
+
+	var names []string
+	for range 3 {
+		e, err := pool.acquire("auto", "fedora33")
+		if err != nil {
+			t.Fatalf("acquire: %v", err)
+		}
+		names = append(names, e.Name)
+	}
+	if want := []string{"big", "local", "big"}; names[0] != want[0] || names[1] != want[1] || names[2] != want[2] {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	if _, err := pool.acquire("big", "ubuntu16"); err == nil {
+		t.Errorf("acquire on unsupported platform succeeded")
+	}
+	pool.release(executors[1])
+	if e, err := pool.acquire("auto", "ubuntu16"); err != nil || e.Name != "local" {
+		t.Errorf("acquire ubuntu16: %v, %v", e, err)
+	}
+}
+
+func TestCopyRepo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	if _, err := gitIn(repo, "init", "-q", "-b", "master"); err != nil {
+		t.Fatal(err)
+	}
+	first := commitFile(t, repo, "a.txt", "a\n")
+	if _, err := gitIn(repo, "branch", "feature"); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "copy")
+	if err := copyRepo("", repo, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later job moves the branch and repacks.
+	second := commitFile(t, repo, "a.txt", "b\n")
+	for _, args := range [][]string{{"branch", "-f", "feature", second}, {"gc", "-q", "--prune=now"}} {
+		if _, err := gitIn(repo, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, err := gitIn(dst, "rev-parse", "feature"); err != nil || got != first {
+		t.Errorf("copy has feature at %q (%v), want %s", got, err, first)
+	}
+	if _, err := gitIn(dst, "cat-file", "-e", first); err != nil {
+		t.Errorf("copy lost %s: %v", first, err)
+	}
+
+	if err := removeRepo("", dst); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dst); !os.IsNotExist(err) {
+		t.Errorf("%s not removed: %v", dst, err)
+	}
+}
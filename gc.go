@@ -0,0 +1,392 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var reviewRunRe = regexp.MustCompile(`issue([0-9]+)_[0-9]+`)
+
+// gcOptions are the --gc_* flags.
+type gcOptions struct {
+	Keep        int
+	MaxAge      time.Duration
+	MaxDisk     string
+	KeepReviews bool
+	DryRun      bool
+}
+
+func (o *gcOptions) register(fs *flag.FlagSet) {
+	fs.IntVar(&o.Keep, "gc_keep", 5, "gc: runs to keep per branch, stage and image")
+	fs.DurationVar(&o.MaxAge, "gc_max_age", 0, "gc: remove runs older than this, if nonzero")
+	fs.StringVar(&o.MaxDisk, "gc_max_disk", "", "gc: cap on total size of the results, e.g. '200G'")
+	fs.BoolVar(&o.KeepReviews, "gc_keep_reviews", true, "gc: keep runs for open Rietveld reviews")
+	fs.BoolVar(&o.DryRun, "gc_dry_run", false, "gc: only print what would be removed")
+}
+
+// storedRun is a run directory in the results tree,
+// NAME/STAGE/IMAGE/COMMIT[.tmp].
+type storedRun struct {
+	Dir  string
+	Time time.Time
+	Size int64
+	Tmp  bool
+
+	// Running is set for unfinished runs that may still be
+	// going.
+	Running bool
+	// Branch is the rebased branch the run was tested on, if any.
+	Branch string
+}
+
+// group is the directory holding the runs and the latest symlink.
+func (r *storedRun) group() string {
+	return filepath.Dir(r.Dir)
+}
+
+// gcPolicy says which runs to remove from the results tree.
+type gcPolicy struct {
+	// KeepLatest is the number of runs kept per group, newest
+	// first. The newest finished run of a group is never removed.
+	KeepLatest int
+	// MaxAge, if nonzero, removes older runs.
+	MaxAge time.Duration
+	// MaxBytes, if nonzero, removes the oldest runs until the
+	// total size fits.
+	MaxBytes int64
+	// OpenReview, if set, reports whether the run belongs to a
+	// code review that is still open. Such runs are kept.
+	OpenReview func(dir string) bool
+}
+
+// garbage returns the runs to remove according to the policy.
+func (p *gcPolicy) garbage(runs []*storedRun, now time.Time) []*storedRun {
+	byGroup := map[string][]*storedRun{}
+	for _, r := range runs {
+		byGroup[r.group()] = append(byGroup[r.group()], r)
+	}
+
+	protected := map[*storedRun]bool{}
+	drop := map[*storedRun]bool{}
+	for _, group := range byGroup {
+		sort.Slice(group, func(i, j int) bool { return group[i].Time.After(group[j].Time) })
+		newestDone := false
+		for i, r := range group {
+			if r.Running || (!r.Tmp && !newestDone) {
+				newestDone = newestDone || !r.Tmp
+				protected[r] = true
+				continue
+			}
+			if i >= p.KeepLatest {
+				drop[r] = true
+			}
+		}
+	}
+
+	for _, r := range runs {
+		if p.OpenReview != nil && p.OpenReview(r.Dir) {
+			protected[r] = true
+		}
+		if p.MaxAge > 0 && now.Sub(r.Time) > p.MaxAge {
+			drop[r] = true
+		}
+	}
+
+	if p.MaxBytes > 0 {
+		var total int64
+		for _, r := range runs {
+			if !drop[r] || protected[r] {
+				total += r.Size
+			}
+		}
+		oldest := append([]*storedRun(nil), runs...)
+		sort.Slice(oldest, func(i, j int) bool { return oldest[i].Time.Before(oldest[j].Time) })
+		for _, r := range oldest {
+			if total <= p.MaxBytes {
+				break
+			}
+			if drop[r] || protected[r] {
+				continue
+			}
+			drop[r] = true
+			total -= r.Size
+		}
+	}
+
+	var result []*storedRun
+	for _, r := range runs {
+		if drop[r] && !protected[r] {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// scanResults lists the runs in the results tree.
+func scanResults(root string) ([]*storedRun, error) {
+	dirs, err := filepath.Glob(filepath.Join(root, "*", "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []*storedRun
+	for _, d := range dirs {
+		fi, err := os.Lstat(d)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			continue
+		}
+		r := &storedRun{
+			Dir:  d,
+			Time: fi.ModTime(),
+			Tmp:  strings.HasSuffix(d, ".tmp"),
+		}
+		var params runParams
+		if err := readJSON(filepath.Join(d, paramsFile), &params); err == nil {
+			r.Time = params.Start
+			if strings.HasPrefix(params.EffectiveBranch, rebasedBranchPrefix) {
+				r.Branch = params.EffectiveBranch
+			}
+			if _, err := os.Stat(filepath.Join(d, resultFile)); os.IsNotExist(err) && r.Tmp {
+				r.Running = time.Since(params.Start) < params.Timeout
+			}
+		}
+		if r.Size, err = dirSize(d); err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, nil
+}
+
+// updateLatest points the latest symlink of the group at its newest
+// finished run, and removes the group directories if they are empty.
+func updateLatest(root, group string) error {
+	latest := filepath.Join(group, "latest")
+	entries, err := os.ReadDir(group)
+	if err != nil {
+		return err
+	}
+
+	var newest string
+	var newestTime time.Time
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		t := time.Time{}
+		var params runParams
+		if err := readJSON(filepath.Join(group, e.Name(), paramsFile), &params); err == nil {
+			t = params.Start
+		} else if fi, err := e.Info(); err == nil {
+			t = fi.ModTime()
+		}
+		if newest == "" || t.After(newestTime) {
+			newest, newestTime = e.Name(), t
+		}
+	}
+
+	if target, err := os.Readlink(latest); err == nil && target == newest {
+		return nil
+	}
+	os.Remove(latest)
+	if newest != "" {
+		return os.Symlink(newest, latest)
+	}
+
+	// Remove empty directories up to the results root.
+	for dir := group; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// parseBytes parses a size with an optional K, M, G or T suffix.
+func parseBytes(s string) (int64, error) {
+	mult := int64(1)
+	suffixes := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+	if m, ok := suffixes[strings.ToUpper(s[len(s)-1:])]; ok {
+		mult = m
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// reviewIsOpen checks with Rietveld whether the review issue is still
+// open. Errors count as open, so results are not lost.
+func reviewIsOpen(issue int) bool {
+	resp, err := http.Get(fmt.Sprintf("https://codereview.appspot.com/api/%d/", issue))
+	if err != nil {
+		log.Printf("review %d: %v", issue, err)
+		return true
+	}
+	defer resp.Body.Close()
+	var rv rietveldData
+	if err := json.NewDecoder(resp.Body).Decode(&rv); err != nil {
+		log.Printf("review %d: %v", issue, err)
+		return true
+	}
+	return !rv.Closed
+}
+
+// policy returns the policy given by the options.
+func (o *gcOptions) policy() (*gcPolicy, error) {
+	p := &gcPolicy{
+		KeepLatest: o.Keep,
+		MaxAge:     o.MaxAge,
+	}
+	if o.MaxDisk != "" {
+		var err error
+		if p.MaxBytes, err = parseBytes(o.MaxDisk); err != nil {
+			return nil, fmt.Errorf("--gc_max_disk: %v", err)
+		}
+	}
+	if o.KeepReviews {
+		open := map[int]bool{}
+		p.OpenReview = func(dir string) bool {
+			m := reviewRunRe.FindStringSubmatch(dir)
+			if m == nil {
+				return false
+			}
+			issue, _ := strconv.Atoi(m[1])
+			o, ok := open[issue]
+			if !ok {
+				o = reviewIsOpen(issue)
+				open[issue] = o
+			}
+			return o
+		}
+	}
+	return p, nil
+}
+
+// collectGarbage removes runs from the results tree according to o,
+// and repairs the latest symlinks.
+func collectGarbage(o *gcOptions) error {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := resultsRoot(cwd)
+	policy, err := o.policy()
+	if err != nil {
+		return err
+	}
+	runs, err := scanResults(root)
+	if err != nil {
+		return err
+	}
+
+	garbage := policy.garbage(runs, time.Now())
+	groups := map[string]bool{}
+	var removed []*indexEntry
+	var freed int64
+	for _, r := range garbage {
+		log.Printf("gc: removing %s (%d MB, %s)", r.Dir, r.Size>>20, r.Time.Format(time.DateOnly))
+		freed += r.Size
+		if o.DryRun {
+			continue
+		}
+		if err := os.RemoveAll(r.Dir); err != nil {
+			return err
+		}
+		groups[r.group()] = true
+		if rel, err := filepath.Rel(root, r.Dir); err == nil {
+			removed = append(removed, &indexEntry{Dir: rel, Removed: true})
+		}
+	}
+	if len(removed) > 0 {
+		if err := appendIndex(root, removed...); err != nil {
+			return err
+		}
+	}
+	for g := range groups {
+		if err := updateLatest(root, g); err != nil {
+			return err
+		}
+	}
+	verb := "removed"
+	if o.DryRun {
+		verb = "would remove"
+	}
+	log.Printf("gc: %s %d of %d runs, %d MB", verb, len(garbage), len(runs), freed>>20)
+	return pruneRebasedBranches(runs, garbage, o.DryRun)
+}
+
+// pruneRebasedBranches deletes the rebased branches in the lilypond
+// checkout that no remaining run refers to.
+func pruneRebasedBranches(runs, garbage []*storedRun, dryRun bool) error {
+	if _, err := os.Stat("lilypond"); os.IsNotExist(err) {
+		return nil
+	}
+	gone := map[*storedRun]bool{}
+	for _, r := range garbage {
+		gone[r] = true
+	}
+	keep := map[string]bool{}
+	for _, r := range runs {
+		if !gone[r] && r.Branch != "" {
+			keep[r.Branch] = true
+		}
+	}
+
+	unlock, err := sched.lockRepo()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	pruned, err := pruneRebased("lilypond", keep, dryRun)
+	if len(pruned) > 0 {
+		verb := "deleted"
+		if dryRun {
+			verb = "would delete"
+		}
+		log.Printf("gc: %s %d rebased branches", verb, len(pruned))
+	}
+	return err
+}
+
+// gcCommand runs garbage collection on the results tree.
+func gcCommand(args []string, o *gcOptions) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: gc")
+	}
+	return collectGarbage(o)
+}
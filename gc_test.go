@@ -0,0 +1,64 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestGCPolicy(t *testing.T) {
+	now := time.Date(2020, 5, 1, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	run := func(dir string, age time.Duration, size int64) *storedRun {
+		return &storedRun{Dir: dir, Time: now.Add(-age), Size: size}
+	}
+
+	a1 := run("r/a/check/img/1", 1*day, 10)
+	a2 := run("r/a/check/img/2", 2*day, 10)
+	a3 := run("r/a/check/img/3", 3*day, 10)
+	aTmp := run("r/a/check/img/4.tmp", 4*day, 10)
+	aTmp.Tmp = true
+	b1 := run("r/issue123_1/check/img/1", 40*day, 10)
+	b2 := run("r/issue123_1/check/img/2", 50*day, 10)
+	runs := []*storedRun{a1, a2, a3, aTmp, b1, b2}
+
+	names := func(rs []*storedRun) []string {
+		var r []string
+		for _, x := range rs {
+			r = append(r, x.Dir)
+		}
+		slices.Sort(r)
+		return r
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy gcPolicy
+		want   []*storedRun
+	}{
+		{"keep", gcPolicy{KeepLatest: 2}, []*storedRun{a3, aTmp}},
+		{"age", gcPolicy{KeepLatest: 10, MaxAge: 30 * day}, []*storedRun{b2}},
+		{"review", gcPolicy{KeepLatest: 1, OpenReview: func(dir string) bool {
+			return reviewRunRe.MatchString(dir)
+		}}, []*storedRun{a2, a3, aTmp}},
+		{"disk", gcPolicy{KeepLatest: 10, MaxBytes: 35}, []*storedRun{b2, aTmp, a3}},
+	} {
+		got := names(tc.policy.garbage(runs, now))
+		if want := names(tc.want); !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	for in, want := range map[string]int64{
+		"100":  100,
+		"2k":   2048,
+		"1.5G": 3 << 29,
+	} {
+		got, err := parseBytes(in)
+		if err != nil || got != want {
+			t.Errorf("parseBytes(%q) = %d, %v, want %d", in, got, err, want)
+		}
+	}
+}
@@ -2,12 +2,26 @@
 
 rm -rf /build/*
 cd /build
+
+# Keep a log with phase markers, so "go run . junit build" can report
+# the run.
+exec > >(tee /build/log.txt) 2>&1
+phase() {
+    echo "@@@ phase $1 $(date +%s)"
+}
+
+phase configure
 /lilypond/autogen.sh --enable-checking --enable-gs-api --disable-debugging CFLAGS=-O2
 N=$(nproc)
 MAKE="make -j$N CPU_COUNT=$N"
 
 
-$MAKE test
-$MAKE doc
+ok=true
+phase test
+$MAKE test || ok=false
+cp out/test-results/index.txt /build/ || true
+phase doc
+$MAKE doc || ok=false
+$ok && phase done
 
 sleep 20m
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Labels set on the base and seed images.
+const (
+	platformLabel = "lilypond-ci.platform"
+	kindLabel     = "lilypond-ci.kind"
+	createdLabel  = "lilypond-ci.created"
+	commitLabel   = "lilypond-ci.commit"
+)
+
+// imageLabels returns docker build options labeling the image of the
+// given kind ("base" or "seed") for the platform. The result is
+// meant for a shell command run from the CI directory.
+func imageLabels(platform, kind string) string {
+	labels := fmt.Sprintf("--label %s=%s --label %s=%s --label %s=%s",
+		platformLabel, platform, kindLabel, kind, createdLabel, time.Now().UTC().Format(time.RFC3339))
+	if kind == "seed" {
+		labels += fmt.Sprintf(" --label %s=$(git -C lilypond rev-parse origin/master)", commitLabel)
+	}
+	return labels
+}
+
+// exportedImage describes an image tarball written by export-images.
+type exportedImage struct {
+	Image    string            `json:"image"`
+	Platform string            `json:"platform"`
+	Kind     string            `json:"kind"`
+	ID       string            `json:"id"`
+	Labels   map[string]string `json:"labels"`
+	File     string            `json:"file"`
+	SHA256   string            `json:"sha256"`
+}
+
+const imageManifestFile = "manifest.json"
+
+func sha256File(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func imageLabelsOf(image string) (map[string]string, error) {
+	out, err := docker("image", "inspect", "--format", "{{json .Config.Labels}}", image)
+	if err != nil {
+		return nil, err
+	}
+	labels := map[string]string{}
+	if err := json.Unmarshal([]byte(out), &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// exportImagesCommand saves the base and seed images to tarballs, so
+// they can be loaded with import-images on a host without network
+// access.
+//
+//	export-images DIR [PLATFORM...]
+//
+// Without platforms, all images present are exported.
+func exportImagesCommand(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: export-images DIR [PLATFORM...]")
+	}
+	dir := args[0]
+	platforms := args[1:]
+	explicit := len(platforms) > 0
+	if !explicit {
+		platforms = allPlatforms
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	var manifest []exportedImage
+	for _, p := range platforms {
+		if !knownPlatform(p) {
+			return fmt.Errorf("unknown platform %q", p)
+		}
+		for _, kind := range []string{"base", "seed"} {
+			image := fmt.Sprintf("lilypond-%s-%s", kind, p)
+			id, err := docker("image", "inspect", "--format", "{{.Id}}", image)
+			if err != nil {
+				if explicit && kind == "base" {
+					return err
+				}
+				continue
+			}
+			labels, err := imageLabelsOf(image)
+			if err != nil {
+				return err
+			}
+			fn := image + ".tar"
+			log.Printf("saving %s to %s", image, fn)
+			if _, err := docker("save", "-o", filepath.Join(dir, fn), image); err != nil {
+				return err
+			}
+			sum, err := sha256File(filepath.Join(dir, fn))
+			if err != nil {
+				return err
+			}
+			manifest = append(manifest, exportedImage{
+				Image:    image,
+				Platform: p,
+				Kind:     kind,
+				ID:       id,
+				Labels:   labels,
+				File:     fn,
+				SHA256:   sum,
+			})
+		}
+	}
+	if len(manifest) == 0 {
+		return fmt.Errorf("no images found")
+	}
+	return writeJSON(filepath.Join(dir, imageManifestFile), manifest)
+}
+
+// importImagesCommand loads the images written by export-images,
+// after verifying their checksums and platforms.
+//
+//	import-images DIR
+func importImagesCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: import-images DIR")
+	}
+	dir := args[0]
+	var manifest []exportedImage
+	if err := readJSON(filepath.Join(dir, imageManifestFile), &manifest); err != nil {
+		return err
+	}
+
+	// Check everything before loading anything.
+	for _, img := range manifest {
+		if !knownPlatform(img.Platform) {
+			return fmt.Errorf("%s: unknown platform %q", img.Image, img.Platform)
+		}
+		if want := fmt.Sprintf("lilypond-%s-%s", img.Kind, img.Platform); img.Image != want {
+			return fmt.Errorf("%s: image name does not match platform, want %s", img.Image, want)
+		}
+		if l := img.Labels[platformLabel]; l != "" && l != img.Platform {
+			return fmt.Errorf("%s: labeled for platform %q", img.Image, l)
+		}
+		sum, err := sha256File(filepath.Join(dir, img.File))
+		if err != nil {
+			return err
+		}
+		if sum != img.SHA256 {
+			return fmt.Errorf("%s: checksum mismatch: got %s, want %s", img.File, sum, img.SHA256)
+		}
+	}
+
+	for _, img := range manifest {
+		log.Printf("loading %s from %s", img.Image, img.File)
+		if _, err := docker("load", "-i", filepath.Join(dir, img.File)); err != nil {
+			return err
+		}
+		id, err := docker("image", "inspect", "--format", "{{.Id}}", img.Image)
+		if err != nil {
+			return err
+		}
+		if id != img.ID {
+			return fmt.Errorf("%s: loaded image has ID %s, want %s", img.Image, id, img.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// indexEntry is a run in the index of the results tree.
+type indexEntry struct {
+	// Dir is the run directory relative to the results root,
+	// NAME/STAGE/IMAGE/COMMIT, with a .tmp suffix for runs that
+	// did not succeed.
+	Dir      string    `json:"dir"`
+	Name     string    `json:"name"`
+	URL      string    `json:"url,omitempty"`
+	Branch   string    `json:"branch,omitempty"`
+	Commit   string    `json:"commit"`
+	Platform string    `json:"platform"`
+	Mode     string    `json:"mode,omitempty"`
+	Stage    string    `json:"stage"`
+	Status   string    `json:"status"`
+	Start    time.Time `json:"start,omitzero"`
+	End      time.Time `json:"end,omitzero"`
+
+	// Suspicious marks a run that took unusually long.
+	Suspicious bool `json:"suspicious,omitempty"`
+
+	// Removed marks a run deleted from the results tree.
+	Removed bool `json:"removed,omitempty"`
+}
+
+// key identifies the run independent of its outcome.
+func (e *indexEntry) key() string {
+	return strings.TrimSuffix(e.Dir, ".tmp")
+}
+
+// Duration returns the run time of a finished run.
+func (e *indexEntry) Duration() time.Duration {
+	if e.End.IsZero() || e.Start.IsZero() {
+		return 0
+	}
+	return e.End.Sub(e.Start)
+}
+
+// The index is a file of JSON lines in the results root. Entries are
+// appended as runs start and finish; the last entry for a run wins.
+const (
+	indexFile     = "index.jsonl"
+	indexLockFile = "index.lock"
+)
+
+// lockIndex takes an exclusive lock on the index of the results
+// tree. It returns a function to release it.
+func lockIndex(root string) (func(), error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(root, indexLockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// appendIndex records entries in the index of the results tree.
+func appendIndex(root string, entries ...*indexEntry) error {
+	unlock, err := lockIndex(root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(filepath.Join(root, indexFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readIndex returns the current entry of each run in the index,
+// ordered by start time. Lines that do not parse, such as an append
+// cut short by a crash, are logged and skipped.
+func readIndex(root string) ([]*indexEntry, error) {
+	f, err := os.Open(filepath.Join(root, indexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	byKey := map[string]*indexEntry{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		var e indexEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("%s:%d: skipping bad entry: %v", indexFile, line, err)
+			continue
+		}
+		byKey[e.key()] = &e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var result []*indexEntry
+	for _, e := range byKey {
+		if !e.Removed {
+			result = append(result, e)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Start.Equal(result[j].Start) {
+			return result[i].Start.Before(result[j].Start)
+		}
+		return result[i].Dir < result[j].Dir
+	})
+	return result, nil
+}
+
+// writeIndex replaces the index with the given entries.
+func writeIndex(root string, entries []*indexEntry) error {
+	unlock, err := lockIndex(root)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tmp := filepath.Join(root, indexFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(root, indexFile))
+}
+
+// newIndexEntry returns the index entry for a run directory, using
+// the stored params and result if present.
+func newIndexEntry(root, dir string) (*indexEntry, error) {
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(rel, string(filepath.Separator))
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("%s: not a run directory", dir)
+	}
+	e := &indexEntry{
+		Dir:    rel,
+		Name:   parts[0],
+		Stage:  parts[1],
+		Commit: strings.TrimSuffix(parts[3], ".tmp"),
+		Status: "ok",
+	}
+	image := parts[2]
+	e.Platform = strings.TrimPrefix(strings.TrimPrefix(image, "lilypond-seed-"), "lilypond-base-")
+	if strings.HasPrefix(image, "lilypond-seed-") {
+		e.Mode = "incremental"
+	}
+	if strings.HasSuffix(dir, ".tmp") {
+		e.Status = "failed"
+	}
+
+	var params runParams
+	if err := readJSON(filepath.Join(dir, paramsFile), &params); err == nil {
+		e.URL = params.URL
+		e.Branch = params.Branch
+		e.Commit = params.Commit
+		e.Platform = params.Platform
+		e.Mode = params.Mode
+		e.Start = params.Start
+		e.Status = "running"
+	} else if fi, err := os.Stat(dir); err == nil {
+		e.Start = fi.ModTime()
+	}
+	var result runResult
+	if err := readJSON(filepath.Join(dir, resultFile), &result); err == nil {
+		e.Status = result.Status
+		e.End = result.End
+		e.Suspicious = result.Suspicious
+	}
+	return e, nil
+}
+
+// indexRun records the current state of the run in dir in the index.
+// Errors are logged, as the index is not essential for running tests.
+func indexRun(root, dir string) {
+	e, err := newIndexEntry(root, dir)
+	if err == nil {
+		err = appendIndex(root, e)
+	}
+	if err != nil {
+		log.Printf("index: %v", err)
+	}
+}
+
+// reindexCommand rebuilds the index from the results tree.
+func reindexCommand(args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: reindex")
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	root := resultsRoot(cwd)
+	runs, err := scanResults(root)
+	if err != nil {
+		return err
+	}
+	var entries []*indexEntry
+	for _, r := range runs {
+		e, err := newIndexEntry(root, r.Dir)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	return writeIndex(root, entries)
+}
+
+// indexQuery selects entries from the index.
+type indexQuery struct {
+	Branch   string
+	Commit   string
+	Platform string
+	Mode     string
+	Stage    string
+	Status   string
+	Since    time.Duration
+}
+
+func (q *indexQuery) register(fs *flag.FlagSet) {
+	fs.StringVar(&q.Branch, "branch", "", "branch or result name")
+	fs.StringVar(&q.Commit, "commit", "", "commit hash prefix")
+	fs.StringVar(&q.Platform, "platform", "", "platform")
+	fs.StringVar(&q.Mode, "mode", "", "mode")
+	fs.StringVar(&q.Stage, "stage", "", "stage")
+	fs.StringVar(&q.Status, "status", "", "status: running, ok or failed")
+	fs.DurationVar(&q.Since, "since", 0, "only runs started within this duration")
+}
+
+func (q *indexQuery) match(e *indexEntry) bool {
+	matches := func(want, got string) bool { return want == "" || want == got }
+	return (q.Branch == "" || q.Branch == e.Branch || q.Branch == e.Name) &&
+		strings.HasPrefix(e.Commit, q.Commit) &&
+		matches(q.Platform, e.Platform) &&
+		matches(q.Mode, e.Mode) &&
+		matches(q.Stage, e.Stage) &&
+		matches(q.Status, e.Status) &&
+		(q.Since == 0 || time.Since(e.Start) < q.Since)
+}
+
+func printEntries(entries []*indexEntry, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", " ")
+		if entries == nil {
+			entries = []*indexEntry{}
+		}
+		return enc.Encode(entries)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "START\tNAME\tCOMMIT\tPLATFORM\tMODE\tSTAGE\tSTATUS\tDURATION")
+		for _, e := range entries {
+			commit := e.Commit
+			if len(commit) > 8 {
+				commit = commit[:8]
+			}
+			duration := e.Duration().Round(time.Second).String()
+			if e.Suspicious {
+				duration += " (slow)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				e.Start.Format("2006-01-02 15:04"), e.Name, commit, e.Platform,
+				e.Mode, e.Stage, e.Status, duration)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+// queryIndex parses the query flags in args and returns the matching
+// index entries, with the requested output format and limit.
+func queryIndex(name string, args []string) ([]*indexEntry, string, int, error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	var q indexQuery
+	q.register(fs)
+	format := fs.String("format", "table", "output format: table or json")
+	limit := fs.Int("limit", 0, "show at most this many runs, newest first")
+	if err := fs.Parse(args); err != nil {
+		return nil, "", 0, err
+	}
+	if fs.NArg() > 0 {
+		return nil, "", 0, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, "", 0, err
+	}
+	all, err := readIndex(resultsRoot(cwd))
+	if err != nil {
+		return nil, "", 0, err
+	}
+	var entries []*indexEntry
+	for _, e := range all {
+		if q.match(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries, *format, *limit, nil
+}
+
+// historyCommand lists runs from the index, newest first.
+//
+//	history [--branch=B] [--platform=P] [--status=ok] [--limit=N] [--format=json] ...
+func historyCommand(args []string) error {
+	entries, format, limit, err := queryIndex("history", args)
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return printEntries(entries, format)
+}
+
+// statusCommand shows the latest run for each combination of name,
+// platform, mode and stage.
+//
+//	status [--branch=B] [--platform=P] [--format=json] ...
+func statusCommand(args []string) error {
+	entries, format, limit, err := queryIndex("status", args)
+	if err != nil {
+		return err
+	}
+	result := latestRuns(entries)
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return printEntries(result, format)
+}
+
+// latestRuns returns the last of the entries, which are in start order,
+// for each combination of name, platform, mode and stage.
+func latestRuns(entries []*indexEntry) []*indexEntry {
+	latest := map[string]*indexEntry{}
+	var keys []string
+	for _, e := range entries {
+		k := strings.Join([]string{e.Name, e.Platform, e.Mode, e.Stage}, "\x00")
+		if latest[k] == nil {
+			keys = append(keys, k)
+		}
+		latest[k] = e
+	}
+	sort.Strings(keys)
+	var result []*indexEntry
+	for _, k := range keys {
+		result = append(result, latest[k])
+	}
+	return result
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadIndex(t *testing.T) {
+	root := t.TempDir()
+	t0 := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := appendIndex(root,
+		&indexEntry{Dir: "b/check/lilypond-base-fedora33/2222.tmp", Status: "running", Start: t0.Add(time.Hour)},
+		&indexEntry{Dir: "a/check/lilypond-base-fedora33/1111", Status: "ok", Start: t0.Add(2 * time.Hour)},
+		&indexEntry{Dir: "c/check/lilypond-base-fedora33/3333", Status: "ok", Start: t0},
+		&indexEntry{Dir: "b/check/lilypond-base-fedora33/2222", Status: "ok", Start: t0.Add(time.Hour)},
+		&indexEntry{Dir: "c/check/lilypond-base-fedora33/3333", Removed: true},
+	); err != nil {
+		t.Fatal(err)
+	}
+	// An append cut short by a crash.
+	f, err := os.OpenFile(filepath.Join(root, indexFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"dir":"d/check/lilypond-base-fedo`)
+	f.Close()
+
+	entries, err := readIndex(root)
+	if err != nil {
+		t.Fatalf("readIndex: %v", err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Dir+" "+e.Status)
+	}
+	want := "b/check/lilypond-base-fedora33/2222 ok,a/check/lilypond-base-fedora33/1111 ok"
+	if strings.Join(got, ",") != want {
+		t.Errorf("got %q, want %q", strings.Join(got, ","), want)
+	}
+
+	if entries, err := readIndex(t.TempDir()); err != nil || entries != nil {
+		t.Errorf("missing index: got %v, %v", entries, err)
+	}
+}
+
+func TestIndexQueryMatch(t *testing.T) {
+	e := &indexEntry{
+		Name: "dev-fix", Branch: "dev/fix", Commit: "abcdef12", Platform: "fedora33",
+		Stage: "check", Status: "ok", Start: time.Now().Add(-time.Hour),
+	}
+	for _, tc := range []struct {
+		q    indexQuery
+		want bool
+	}{
+		{indexQuery{}, true},
+		{indexQuery{Branch: "dev/fix"}, true},
+		{indexQuery{Branch: "dev-fix"}, true},
+		{indexQuery{Branch: "master"}, false},
+		{indexQuery{Commit: "abc"}, true},
+		{indexQuery{Commit: "bcd"}, false},
+		{indexQuery{Platform: "fedora33", Stage: "check", Status: "ok"}, true},
+		{indexQuery{Mode: "incremental"}, false},
+		{indexQuery{Since: 2 * time.Hour}, true},
+		{indexQuery{Since: time.Minute}, false},
+	} {
+		if got := tc.q.match(e); got != tc.want {
+			t.Errorf("%+v: got %v, want %v", tc.q, got, tc.want)
+		}
+	}
+}
+
+func TestNewIndexEntry(t *testing.T) {
+	root := t.TempDir()
+	for _, tc := range []struct {
+		dir  string
+		want indexEntry
+	}{
+		{"master/check/lilypond-base-fedora33/abcd1234", indexEntry{
+			Name: "master", Stage: "check", Commit: "abcd1234", Platform: "fedora33", Status: "ok"}},
+		{"dev/build/lilypond-seed-ubuntu20/1234abcd.tmp", indexEntry{
+			Name: "dev", Stage: "build", Commit: "1234abcd", Platform: "ubuntu20", Mode: "incremental", Status: "failed"}},
+	} {
+		dir := filepath.Join(root, tc.dir)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		e, err := newIndexEntry(root, dir)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.dir, err)
+		}
+		tc.want.Dir = tc.dir
+		e.Start = time.Time{}
+		if *e != tc.want {
+			t.Errorf("%s: got %+v, want %+v", tc.dir, *e, tc.want)
+		}
+	}
+
+	// A run with params but no result is still running.
+	dir := filepath.Join(root, "master/check/lilypond-base-fedora33/5678.tmp")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := writeJSON(filepath.Join(dir, paramsFile), &runParams{Commit: "5678", Branch: "master", Platform: "fedora33", Start: start}); err != nil {
+		t.Fatal(err)
+	}
+	e, err := newIndexEntry(root, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != "running" || !e.Start.Equal(start) || e.Branch != "master" {
+		t.Errorf("running: got %+v", e)
+	}
+
+	if _, err := newIndexEntry(root, filepath.Join(root, "master/check")); err == nil {
+		t.Error("want error for a directory that is not a run")
+	}
+}
+
+func TestLatestRuns(t *testing.T) {
+	entries := []*indexEntry{
+		{Name: "master", Platform: "fedora33", Stage: "check", Commit: "1"},
+		{Name: "master", Platform: "ubuntu20", Stage: "check", Commit: "2"},
+		{Name: "dev", Platform: "fedora33", Stage: "check", Commit: "3"},
+		{Name: "master", Platform: "fedora33", Stage: "check", Commit: "4"},
+		{Name: "master", Platform: "fedora33", Mode: "incremental", Stage: "check", Commit: "5"},
+	}
+	var got []string
+	for _, e := range latestRuns(entries) {
+		got = append(got, e.Commit)
+	}
+	if want := "3,4,5,2"; strings.Join(got, ",") != want {
+		t.Errorf("got %s, want %s", strings.Join(got, ","), want)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JUnit XML, as understood by GitLab and most CI dashboards.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Time     float64         `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (s *junitTestSuite) add(c junitTestCase) {
+	s.Cases = append(s.Cases, c)
+	s.Tests++
+	s.Time += c.Time
+	if c.Failure != nil {
+		s.Failures++
+	}
+}
+
+const (
+	junitFile = "junit.xml"
+	logFile   = "log.txt"
+
+	// maxFailureText limits the log text attached to a failure.
+	maxFailureText = 64 << 10
+)
+
+// phase is a build phase, as marked by the phase function in the
+// driver scripts.
+type phase struct {
+	Name  string
+	Start time.Time
+	End   time.Time
+	Log   []string
+}
+
+var phaseRe = regexp.MustCompile(`^@@@ phase (\S+) ([0-9]+)$`)
+
+// parsePhases splits a run log into phases. Log lines outside phases
+// are dropped. The "done" marker ends a phase without starting a new
+// one; if the log does not end with it, the run did not complete its
+// last phase.
+func parsePhases(r io.Reader) (phases []*phase, done bool, err error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	var cur *phase
+	for scanner.Scan() {
+		line := scanner.Text()
+		m := phaseRe.FindStringSubmatch(line)
+		if m == nil {
+			if cur != nil {
+				cur.Log = append(cur.Log, line)
+			}
+			continue
+		}
+		secs, _ := strconv.ParseInt(m[2], 10, 64)
+		t := time.Unix(secs, 0)
+		if cur != nil {
+			cur.End = t
+		}
+		cur = nil
+		done = m[1] == "done"
+		if !done {
+			cur = &phase{Name: m[1], Start: t}
+			phases = append(phases, cur)
+		}
+	}
+	return phases, done, scanner.Err()
+}
+
+// regtestChange is a changed regression test, from the index.txt of
+// the test results.
+type regtestChange struct {
+	Name     string
+	Distance float64
+}
+
+var regtestRe = regexp.MustCompile(`^\s*([0-9.e+-]+)\s+(\S+)\s*$`)
+
+func parseRegtestIndex(r io.Reader) ([]regtestChange, error) {
+	var changes []regtestChange
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		m := regtestRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
+		}
+		d, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			continue
+		}
+		changes = append(changes, regtestChange{Name: m[2], Distance: d})
+	}
+	return changes, scanner.Err()
+}
+
+func tail(lines []string, max int) string {
+	text := strings.Join(lines, "\n")
+	if len(text) > max {
+		text = "...\n" + text[len(text)-max:]
+	}
+	return text
+}
+
+// junitReport builds a JUnit report for the run in dir. Build phases
+// are test cases of one suite; changed regression tests are failures
+// in a second suite. Either the log or the test results may be
+// missing.
+func junitReport(dir string) (*junitTestSuites, error) {
+	var params runParams
+	className := "lilypond"
+	suiteName := filepath.Base(dir)
+	if err := readJSON(filepath.Join(dir, paramsFile), &params); err == nil {
+		className = fmt.Sprintf("lilypond.%s.%s.%s", params.Platform, params.Mode, params.Stage)
+		suiteName = fmt.Sprintf("%s %s %s on %s", params.URL, params.Branch, params.Stage, params.Platform)
+	}
+	var result runResult
+	if err := readJSON(filepath.Join(dir, resultFile), &result); err != nil {
+		result.Status = "ok"
+		if strings.HasSuffix(dir, ".tmp") {
+			result.Status = "failed"
+		}
+	}
+	failed := result.Status != "ok"
+
+	// Logs from failing make rules, copied by the driver scripts.
+	failLogs, err := filepath.Glob(filepath.Join(dir, "*.fail.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(failLogs)
+	var failText strings.Builder
+	for _, fn := range failLogs {
+		content, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&failText, "=== %s\n%s\n", filepath.Base(fn), tail(strings.Split(string(content), "\n"), maxFailureText))
+	}
+
+	build := junitTestSuite{Name: suiteName + " build"}
+	var phases []*phase
+	done := false
+	if f, err := os.Open(filepath.Join(dir, logFile)); err == nil {
+		phases, done, err = parsePhases(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(phases) == 0 {
+		phases = []*phase{{Name: "run", Start: params.Start, End: result.End}}
+		done = !failed
+	}
+	for i, p := range phases {
+		c := junitTestCase{
+			Name:      p.Name,
+			ClassName: className,
+		}
+		if !p.End.IsZero() {
+			c.Time = p.End.Sub(p.Start).Seconds()
+		}
+		last := i == len(phases)-1
+		if last && (failed || !done) {
+			msg := result.Error
+			if msg == "" {
+				msg = "phase did not complete"
+			}
+			typ := "BuildFailure"
+			if result.Status == "conflict" {
+				typ = "RebaseConflict"
+			}
+			c.Failure = &junitFailure{
+				Message: msg,
+				Type:    typ,
+				Text:    failText.String() + tail(p.Log, maxFailureText),
+			}
+		}
+		build.add(c)
+	}
+	report := &junitTestSuites{Suites: []junitTestSuite{build}}
+
+	f, err := os.Open(filepath.Join(dir, "index.txt"))
+	if os.IsNotExist(err) {
+		return report, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	changes, err := parseRegtestIndex(f)
+	if err != nil {
+		return nil, err
+	}
+	regtests := junitTestSuite{Name: suiteName + " regtests"}
+	for _, ch := range changes {
+		regtests.add(junitTestCase{
+			Name:      ch.Name,
+			ClassName: className + ".regtest",
+			Failure: &junitFailure{
+				Message: fmt.Sprintf("output changed, distance %f", ch.Distance),
+				Type:    "RegtestChange",
+			},
+		})
+	}
+	report.Suites = append(report.Suites, regtests)
+	return report, nil
+}
+
+func (r *junitTestSuites) write(w io.Writer) error {
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", " ")
+	if err := enc.Encode(r); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeJUnit stores the JUnit report for the run in dir as junit.xml.
+func writeJUnit(dir string) error {
+	report, err := junitReport(dir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(filepath.Join(dir, junitFile))
+	if err != nil {
+		return err
+	}
+	if err := report.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// junitCommand writes the JUnit report for a result directory, or for
+// a LilyPond test-results directory, to stdout.
+//
+//	junit DIR
+func junitCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: junit DIR")
+	}
+	report, err := junitReport(args[0])
+	if err != nil {
+		return err
+	}
+	return report.write(os.Stdout)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestJUnitReport(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "abcd1234.tmp")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		logFile: `noise
+@@@ phase checkout 100
+@@@ phase build 110
+make: *** [all] Error 2
+`,
+		"lily.fail.log": "compile error\n",
+		"index.txt": `
+0.500000                       beams.ly
+1.250000                       slurs.ly
+`,
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := junitReport(dir)
+	if err != nil {
+		t.Fatalf("junitReport: %v", err)
+	}
+	if len(report.Suites) != 2 {
+		t.Fatalf("got %d suites, want 2", len(report.Suites))
+	}
+	build := report.Suites[0]
+	if build.Tests != 2 || build.Failures != 1 {
+		t.Errorf("build suite: got %d tests, %d failures", build.Tests, build.Failures)
+	}
+	if c := build.Cases[0]; c.Name != "checkout" || c.Time != 10 || c.Failure != nil {
+		t.Errorf("checkout: %+v", c)
+	}
+	if f := build.Cases[1].Failure; f == nil || !strings.Contains(f.Text, "compile error") || !strings.Contains(f.Text, "Error 2") {
+		t.Errorf("build failure: %+v", f)
+	}
+	if regtests := report.Suites[1]; regtests.Failures != 2 || regtests.Cases[1].Name != "slurs.ly" {
+		t.Errorf("regtests: %+v", regtests)
+	}
+
+	var buf bytes.Buffer
+	if err := report.write(&buf); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if !strings.Contains(buf.String(), `<testcase name="beams.ly"`) {
+		t.Errorf("missing regtest case in %s", buf.String())
+	}
+}
+
+func TestJUnitReportConflict(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "abcd1234-on-5678abcd.tmp")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeJSON(filepath.Join(dir, resultFile), &runResult{
+		Status: "conflict",
+		Error:  "rebase onto 5678abcd: conflict in lily/beam.cc",
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, logFile), []byte("rebase onto 5678abcd: conflict in lily/beam.cc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := junitReport(dir)
+	if err != nil {
+		t.Fatalf("junitReport: %v", err)
+	}
+	build := report.Suites[0]
+	if build.Failures != 1 {
+		t.Fatalf("got %d failures, want 1: %+v", build.Failures, build)
+	}
+	if f := build.Cases[0].Failure; f.Type != "RebaseConflict" || !strings.Contains(f.Message, "conflict") {
+		t.Errorf("failure: %+v", f)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the histogram buckets for run durations, in
+// seconds.
+var durationBuckets = []float64{300, 900, 1800, 3600, 2 * 3600, 4 * 3600, 8 * 3600, 24 * 3600}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// metrics collects the state of the server for Prometheus, in the
+// text exposition format.
+type metrics struct {
+	mu sync.Mutex
+	// running counts running jobs by platform.
+	running map[string]int
+	// finished counts finished jobs by platform, mode, stage and
+	// status.
+	finished map[[4]string]int
+	// durations has run durations by mode and stage.
+	durations map[[2]string]*histogram
+
+	resultsBytes int64
+	// seedCreated has the creation time of the seed images, by
+	// platform.
+	seedCreated map[string]time.Time
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		running:     map[string]int{},
+		finished:    map[[4]string]int{},
+		durations:   map[[2]string]*histogram{},
+		seedCreated: map[string]time.Time{},
+	}
+}
+
+func (m *metrics) start(j *job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running[j.Platform]++
+}
+
+func (m *metrics) finish(j *job, status string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.running[j.Platform]--
+	m.finished[[4]string{j.Platform, j.Mode, j.Stage, status}]++
+	k := [2]string{j.Mode, j.Stage}
+	if m.durations[k] == nil {
+		m.durations[k] = newHistogram(durationBuckets)
+	}
+	m.durations[k].observe(d.Seconds())
+}
+
+// watchDisk updates the size of the results tree periodically. Walking
+// the tree is too slow to do for every scrape.
+func (m *metrics) watchDisk(root string, interval time.Duration) {
+	for {
+		size, err := dirSize(root)
+		if err != nil {
+			log.Printf("metrics: %v", err)
+		} else {
+			m.mu.Lock()
+			m.resultsBytes = size
+			m.mu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// watchSeedImages updates the creation times of the seed images
+// periodically, so scrapes do not wait for docker.
+func (m *metrics) watchSeedImages(interval time.Duration) {
+	for {
+		created := map[string]time.Time{}
+		for _, p := range append([]string{releasePlatform}, allPlatforms...) {
+			if t, ok := seedImageCreated(p); ok {
+				created[p] = t
+			}
+		}
+		m.mu.Lock()
+		m.seedCreated = created
+		m.mu.Unlock()
+		time.Sleep(interval)
+	}
+}
+
+// seedImageCreated returns the creation time of the seed image for the
+// platform.
+func seedImageCreated(platform string) (time.Time, bool) {
+	out, err := exec.Command("docker", "image", "inspect", "--format", "{{.Created}}", "lilypond-seed-"+platform).Output()
+	if err != nil {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(out)))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return created, true
+}
+
+func labels(kv ...string) string {
+	var parts []string
+	for i := 0; i < len(kv); i += 2 {
+		parts = append(parts, kv[i]+"="+strconv.Quote(kv[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer, queueDepth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeHeader(w, "lilypond_ci_queue_depth", "gauge", "Jobs waiting to run.")
+	fmt.Fprintf(w, "lilypond_ci_queue_depth %d\n", queueDepth)
+
+	writeHeader(w, "lilypond_ci_running_jobs", "gauge", "Jobs running, by platform.")
+	// All platforms are listed, and others with jobs, such as the
+	// release platform.
+	platforms := append([]string(nil), allPlatforms...)
+	for p := range m.running {
+		if !known(allPlatforms, p) {
+			platforms = append(platforms, p)
+		}
+	}
+	sort.Strings(platforms)
+	for _, p := range platforms {
+		fmt.Fprintf(w, "lilypond_ci_running_jobs%s %d\n", labels("platform", p), m.running[p])
+	}
+
+	var keys [][4]string
+	for k := range m.finished {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return strings.Join(keys[i][:], " ") < strings.Join(keys[j][:], " ") })
+	writeHeader(w, "lilypond_ci_runs_total", "counter", "Finished runs, by platform, mode, stage and status.")
+	for _, k := range keys {
+		fmt.Fprintf(w, "lilypond_ci_runs_total%s %d\n",
+			labels("platform", k[0], "mode", k[1], "stage", k[2], "status", k[3]), m.finished[k])
+	}
+	writeHeader(w, "lilypond_ci_run_failures_total", "counter", "Failed runs, by platform, mode and stage.")
+	for _, k := range keys {
+		if k[3] == "failed" {
+			fmt.Fprintf(w, "lilypond_ci_run_failures_total%s %d\n",
+				labels("platform", k[0], "mode", k[1], "stage", k[2]), m.finished[k])
+		}
+	}
+
+	var dkeys [][2]string
+	for k := range m.durations {
+		dkeys = append(dkeys, k)
+	}
+	sort.Slice(dkeys, func(i, j int) bool { return dkeys[i][0]+" "+dkeys[i][1] < dkeys[j][0]+" "+dkeys[j][1] })
+	writeHeader(w, "lilypond_ci_run_duration_seconds", "histogram", "Run durations, by mode and stage.")
+	for _, k := range dkeys {
+		h := m.durations[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "lilypond_ci_run_duration_seconds_bucket%s %d\n",
+				labels("mode", k[0], "stage", k[1], "le", formatFloat(b)), h.counts[i])
+		}
+		fmt.Fprintf(w, "lilypond_ci_run_duration_seconds_bucket%s %d\n",
+			labels("mode", k[0], "stage", k[1], "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "lilypond_ci_run_duration_seconds_sum%s %s\n", labels("mode", k[0], "stage", k[1]), formatFloat(h.sum))
+		fmt.Fprintf(w, "lilypond_ci_run_duration_seconds_count%s %d\n", labels("mode", k[0], "stage", k[1]), h.count)
+	}
+
+	writeHeader(w, "lilypond_ci_seed_image_age_seconds", "gauge", "Age of the seed image, by platform.")
+	var seeds []string
+	for p := range m.seedCreated {
+		seeds = append(seeds, p)
+	}
+	sort.Strings(seeds)
+	for _, p := range seeds {
+		age := time.Since(m.seedCreated[p])
+		fmt.Fprintf(w, "lilypond_ci_seed_image_age_seconds%s %s\n", labels("platform", p), formatFloat(age.Seconds()))
+	}
+
+	writeHeader(w, "lilypond_ci_results_bytes", "gauge", "Disk usage of the results tree.")
+	fmt.Fprintf(w, "lilypond_ci_results_bytes %d\n", m.resultsBytes)
+}
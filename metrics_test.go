@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := newMetrics()
+	j := &job{Platform: "fedora33", Mode: "full", Stage: "check"}
+	m.start(j)
+	m.finish(j, "failed", 20*time.Minute)
+	m.start(j)
+	m.start(&job{Platform: releasePlatform, Mode: "release", Stage: "build"})
+	m.seedCreated["fedora33"] = time.Now().Add(-time.Hour)
+
+	var buf bytes.Buffer
+	m.write(&buf, 2)
+	out := buf.String()
+	for _, want := range []string{
+		"lilypond_ci_queue_depth 2\n",
+		`lilypond_ci_running_jobs{platform="fedora33"} 1` + "\n",
+		`lilypond_ci_running_jobs{platform="` + releasePlatform + `"} 1` + "\n",
+		`lilypond_ci_seed_image_age_seconds{platform="fedora33"} 3600`,
+		`lilypond_ci_run_failures_total{platform="fedora33",mode="full",stage="check"} 1` + "\n",
+		`lilypond_ci_run_duration_seconds_bucket{mode="full",stage="check",le="900"} 0` + "\n",
+		`lilypond_ci_run_duration_seconds_bucket{mode="full",stage="check",le="1800"} 1` + "\n",
+		`lilypond_ci_run_duration_seconds_sum{mode="full",stage="check"} 1200` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// rebasedBranchPrefix is the prefix of the branches in the lilypond
+// checkout holding the rebased commits. They are kept for repro until
+// gc removes their run.
+const rebasedBranchPrefix = "ci-rebased/"
+
+// rebaseConflict is the error for a branch that does not apply
+// cleanly on origin/master.
+type rebaseConflict struct {
+	Strategy string
+	Files    []string
+}
+
+func (e *rebaseConflict) Error() string {
+	return fmt.Sprintf("%s onto origin/master: conflicts in %s", e.Strategy, strings.Join(e.Files, " "))
+}
+
+// gitIn runs git in dir, and returns its trimmed output.
+func gitIn(dir string, args ...string) (string, error) {
+	// Rebasing and merging create commits, so they need an identity.
+	cmd := exec.Command("git", append([]string{"-C", dir,
+		"-c", "user.name=lilypond-ci", "-c", "user.email=lilypond-ci@localhost"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %v: %v\n%s", args, err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ontoMaster rebases or merges commit onto baseline in a temporary
+// worktree of repo, leaving the checkout of repo alone. The result is
+// stored in branch, and returned. A conflict is returned as a
+// *rebaseConflict.
+func ontoMaster(repo, strategy, commit, baseline, branch string) (string, error) {
+	if strategy != "rebase" && strategy != "merge" {
+		return "", fmt.Errorf("unknown --rebase strategy %q", strategy)
+	}
+	wt, err := os.MkdirTemp("", "lilypond-rebase-")
+	if err != nil {
+		return "", err
+	}
+	os.Remove(wt)
+	if _, err := gitIn(repo, "worktree", "add", "--detach", wt, commit); err != nil {
+		return "", err
+	}
+	defer func() {
+		if _, err := gitIn(repo, "worktree", "remove", "--force", wt); err != nil {
+			log.Printf("worktree remove: %v", err)
+		}
+	}()
+
+	var opErr error
+	if strategy == "rebase" {
+		_, opErr = gitIn(wt, "rebase", baseline)
+	} else {
+		_, opErr = gitIn(wt, "merge", "--no-edit", baseline)
+	}
+	if opErr != nil {
+		out, err := gitIn(wt, "diff", "--name-only", "--diff-filter=U")
+		if err != nil || out == "" {
+			return "", opErr
+		}
+		gitIn(wt, strategy, "--abort")
+		return "", &rebaseConflict{
+			Strategy: strategy,
+			Files:    strings.Split(out, "\n"),
+		}
+	}
+
+	result, err := gitIn(wt, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	if _, err := gitIn(repo, "update-ref", "refs/heads/"+branch, result); err != nil {
+		return "", err
+	}
+	return result, nil
+}
+
+// pruneRebased deletes the rebased branches in repo that are not in
+// keep, and returns their names. With dryRun, it only lists them.
+func pruneRebased(repo string, keep map[string]bool, dryRun bool) ([]string, error) {
+	out, err := gitIn(repo, "for-each-ref", "--format=%(refname)", "refs/heads/"+rebasedBranchPrefix)
+	if err != nil {
+		return nil, err
+	}
+	var pruned []string
+	for _, ref := range strings.Fields(out) {
+		branch := strings.TrimPrefix(ref, "refs/heads/")
+		if keep[branch] {
+			continue
+		}
+		if !dryRun {
+			if _, err := gitIn(repo, "update-ref", "-d", ref); err != nil {
+				return pruned, err
+			}
+		}
+		pruned = append(pruned, branch)
+	}
+	return pruned, nil
+}
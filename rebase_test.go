@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// commitFile commits content to fn in the git repo at dir, and
+// returns the new commit.
+func commitFile(t *testing.T, dir, fn, content string) string {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, fn), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitIn(dir, "add", fn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gitIn(dir, "commit", "-q", "-m", fn); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := gitIn(dir, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestOntoMaster(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	if _, err := gitIn(repo, "init", "-q", "-b", "master"); err != nil {
+		t.Fatal(err)
+	}
+	base := commitFile(t, repo, "a.txt", "a\n")
+	if _, err := gitIn(repo, "checkout", "-q", "-b", "feature"); err != nil {
+		t.Fatal(err)
+	}
+	feature := commitFile(t, repo, "b.txt", "feature\n")
+	if _, err := gitIn(repo, "checkout", "-q", base); err != nil {
+		t.Fatal(err)
+	}
+	master := commitFile(t, repo, "c.txt", "master\n")
+
+	for _, strategy := range []string{"rebase", "merge"} {
+		branch := "ci-rebased/" + strategy
+		got, err := ontoMaster(repo, strategy, feature, master, branch)
+		if err != nil {
+			t.Fatalf("ontoMaster(%s): %v", strategy, err)
+		}
+		if _, err := gitIn(repo, "merge-base", "--is-ancestor", master, got); err != nil {
+			t.Errorf("%s: %s is not on top of master", strategy, got)
+		}
+		if ref, err := gitIn(repo, "rev-parse", branch); err != nil || ref != got {
+			t.Errorf("%s: branch at %q (%v), want %s", strategy, ref, err, got)
+		}
+	}
+
+	conflicting := commitFile(t, repo, "b.txt", "master\n")
+	_, err := ontoMaster(repo, "rebase", feature, conflicting, "ci-rebased/conflict")
+	var conflict *rebaseConflict
+	if !errors.As(err, &conflict) {
+		t.Fatalf("got %v, want a conflict", err)
+	}
+	if want := []string{"b.txt"}; !reflect.DeepEqual(conflict.Files, want) {
+		t.Errorf("got conflicts in %q, want %q", conflict.Files, want)
+	}
+	if out, err := gitIn(repo, "worktree", "list", "--porcelain"); err != nil {
+		t.Fatal(err)
+	} else if n := strings.Count(out, "worktree "); n != 1 {
+		t.Errorf("got %d worktrees, want 1:\n%s", n, out)
+	}
+}
+
+func TestPruneRebased(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	repo := t.TempDir()
+	if _, err := gitIn(repo, "init", "-q", "-b", "master"); err != nil {
+		t.Fatal(err)
+	}
+	commitFile(t, repo, "a.txt", "a\n")
+	for _, b := range []string{"ci-rebased/old", "ci-rebased/kept", "feature"} {
+		if _, err := gitIn(repo, "branch", b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keep := map[string]bool{"ci-rebased/kept": true}
+	if got, err := pruneRebased(repo, keep, true); err != nil || !reflect.DeepEqual(got, []string{"ci-rebased/old"}) {
+		t.Fatalf("dry run: got %v, %v", got, err)
+	}
+	if _, err := gitIn(repo, "rev-parse", "--verify", "ci-rebased/old"); err != nil {
+		t.Errorf("dry run deleted the branch: %v", err)
+	}
+	if _, err := pruneRebased(repo, keep, false); err != nil {
+		t.Fatal(err)
+	}
+	out, err := gitIn(repo, "branch", "--format=%(refname:short)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Fields(out), []string{"ci-rebased/kept", "feature", "master"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("branches: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+)
+
+// releasePlatform is the platform of the release mode. Its image,
+// built from ubuntu-2204-binary-release.dockerfile, has the
+// toolchains for the static release binaries.
+const releasePlatform = "ubuntu22-release"
+
+// smokeImage is a distribution image without LilyPond's dependencies,
+// to check that the release binaries are self-contained.
+const smokeImage = "ubuntu:22.04"
+
+// smokeTestRelease compiles the files in compare-testdata with each
+// Linux binary built by test-release.sh, in a clean container. runDest
+// holds the output of the release build. The smoke run gets the
+// timeout of the run.
+func smokeTestRelease(p *runParams, runDest string, logw io.Writer) error {
+	dir := filepath.Dir(p.Script)
+	cmd := dockerCommand(p.DockerHost, "run", "--rm=true",
+		"-v", runDest+":/output",
+		"-v", filepath.Join(dir, "compare-testdata")+":/input:ro",
+		"-v", filepath.Join(dir, "smoke-release.sh")+":/smoke.sh:ro",
+		smokeImage, "timeout", "--signal=KILL", fmt.Sprintf("%f", p.Timeout.Seconds()), "/smoke.sh")
+	cmd.Stdout = logw
+	cmd.Stderr = logw
+	log.Printf("running: %v", cmd.Args)
+	return cmd.Run()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// reproCommand starts an interactive container for the run stored in
+// the given result directory. The container has the same mounts and
+// image as the original run, and the tested commit checked out in
+// /lilypond. The driver script is mounted as /test.sh, but not run.
+//
+// If the container of the failed run was kept, the shell starts in
+// its file system instead, with the build tree as it was left.
+func reproCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: repro RESULT-DIR")
+	}
+	dir, err := filepath.Abs(args[0])
+	if err != nil {
+		return err
+	}
+
+	var p runParams
+	if err := readJSON(filepath.Join(dir, paramsFile), &p); err != nil {
+		return err
+	}
+
+	image := p.SeedImage
+	var result runResult
+	if err := readJSON(filepath.Join(dir, resultFile), &result); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if result.Snapshot != "" {
+		image = result.Snapshot
+	} else if result.Container != "" {
+		id, err := dockerOn(p.DockerHost, "commit", result.Container)
+		if err != nil {
+			return err
+		}
+		defer dockerOn(p.DockerHost, "rmi", id)
+		image = id
+	}
+
+	// Use a scratch output directory, so the stored results stay
+	// intact. On remote hosts, docker creates it.
+	out := fmt.Sprintf("/tmp/lilypond-repro-%d", os.Getpid())
+	if p.DockerHost == "" {
+		if out, err = os.MkdirTemp("", "lilypond-repro"); err != nil {
+			return err
+		}
+	}
+
+	testCmd := strings.Join(p.scriptArgs(), " ")
+	if p.Mode != "incremental" {
+		// The full and separate scripts create /lilypond themselves.
+		testCmd = "rm -rf /lilypond && " + testCmd
+	}
+	checkout := fmt.Sprintf(`if [ ! -d /lilypond/.git ]; then
+  mkdir -p /lilypond && cp -a %[1]s/.git /lilypond/
+fi
+cd /lilypond
+git fetch -q %[1]s '+refs/heads/*:refs/remotes/local/*'
+git checkout -q -f %[2]s
+`, localRepo, p.testedCommit())
+	if image != p.SeedImage {
+		checkout = "cd /lilypond\n"
+	}
+	prelude := fmt.Sprintf(`set -e
+%s
+echo
+echo "reproducing %s %s on %s mode %s stage %s"
+echo "output goes to %s"
+echo "to run the test: %s"
+echo
+exec /bin/bash
+`, checkout, p.URL, p.Branch, p.Platform, p.Mode, p.Stage, out, testCmd)
+
+	// The copy of the repository for the run is gone.
+	p.RunRepo = ""
+	dockerArgs := append([]string{"run", "-it", "--rm=true"}, p.mounts(out)...)
+	dockerArgs = append(dockerArgs, image, "/bin/bash", "-c", prelude)
+	cmd := dockerCommand(p.DockerHost, dockerArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	log.Printf("running: %v", cmd.Args)
+	return cmd.Run()
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	maxContainers = flag.Int("max_containers", 1, "maximum number of test containers running on this machine")
+	lockDir       = flag.String("lock_dir", filepath.Join(os.TempDir(), "lilypond-ci"), "directory for the locks shared by all users of this machine")
+	priority      = flag.Int("priority", 0, "scheduling priority; higher runs first")
+)
+
+// masterPriority is added to the priority of runs of master, so
+// regression runs go before experimental branches.
+const masterPriority = 10
+
+// runPriority returns the scheduling priority of a run of branch.
+func runPriority(branch string, prio int) int {
+	if branch == "master" || branch == "origin/master" {
+		prio += masterPriority
+	}
+	return prio
+}
+
+// scheduler coordinates test runs sharing a machine.
+type scheduler interface {
+	// lockRepo serializes access to the lilypond checkout. It
+	// returns a function to release the lock.
+	lockRepo() (func(), error)
+
+	// acquire waits for n container slots. Waiters with a higher
+	// priority go first, and otherwise the one waiting longest. It
+	// returns a function to release the slots.
+	acquire(prio, n int) (func(), error)
+}
+
+// sched is the scheduler of this process. The serve command schedules
+// in-process; otherwise runs are coordinated through files in
+// --lock_dir.
+var sched scheduler
+
+// memScheduler schedules the runs within a process.
+type memScheduler struct {
+	repo sync.Mutex
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int
+	used    int
+	seq     int
+	waiters []*slotRequest
+}
+
+type slotRequest struct {
+	prio int
+	seq  int
+}
+
+func newMemScheduler(max int) *memScheduler {
+	s := &memScheduler{max: max}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *memScheduler) lockRepo() (func(), error) {
+	s.repo.Lock()
+	return s.repo.Unlock, nil
+}
+
+func (s *memScheduler) acquire(prio, n int) (func(), error) {
+	n = min(n, s.max)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	req := &slotRequest{prio: prio, seq: s.seq}
+	s.waiters = append(s.waiters, req)
+	sort.SliceStable(s.waiters, func(i, j int) bool {
+		return s.waiters[i].prio > s.waiters[j].prio
+	})
+	for s.waiters[0] != req || s.used+n > s.max {
+		s.cond.Wait()
+	}
+	s.waiters = s.waiters[1:]
+	s.used += n
+	// The next waiter may fit too.
+	s.cond.Broadcast()
+
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.used -= n
+		s.cond.Broadcast()
+	}, nil
+}
+
+// fileScheduler schedules the runs of all processes on the machine
+// using flock(2) on files in dir, so locks of crashed processes are
+// released. The container slots are the files slot.N.lock. Waiting
+// processes hold a lock on their own file in queue/, named
+// PRIORITY.NANOS.PID; the first waiter in order takes the free slots.
+type fileScheduler struct {
+	dir  string
+	max  int
+	poll time.Duration
+}
+
+func newFileScheduler(dir string, max int) *fileScheduler {
+	return &fileScheduler{dir: dir, max: max, poll: time.Second}
+}
+
+// lockFile opens fn and locks it. With block unset, it returns nil
+// if the file is locked by someone else. The file is opened read-only,
+// which is enough for flock, so files created by other users under
+// their umask can be locked too.
+func lockFile(fn string, block bool) (*os.File, error) {
+	f, err := os.OpenFile(fn, os.O_CREATE|os.O_RDONLY, 0666)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_EX
+	if !block {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err == syscall.EWOULDBLOCK {
+		f.Close()
+		return nil, nil
+	} else if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// mkdir creates a directory that all users of the machine can use.
+func (s *fileScheduler) mkdir(dir string) error {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	// Make it shared despite the umask; this fails if someone
+	// else created it, who will have done the same.
+	os.Chmod(dir, 01777)
+	return nil
+}
+
+func (s *fileScheduler) lockRepo() (func(), error) {
+	if err := s.mkdir(s.dir); err != nil {
+		return nil, err
+	}
+	f, err := lockFile(filepath.Join(s.dir, "repo.lock"), true)
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+type queueEntry struct {
+	name  string
+	prio  int
+	nanos int64
+}
+
+// queue returns the live waiters in order, removing the entries of
+// processes that died. Entries are locked by their waiter before they
+// get their PRIORITY.NANOS.PID name, so an unlocked entry is dead.
+func (s *fileScheduler) queue(qdir string) ([]queueEntry, error) {
+	des, err := os.ReadDir(qdir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []queueEntry
+	for _, de := range des {
+		fields := strings.Split(de.Name(), ".")
+		if len(fields) != 3 {
+			continue
+		}
+		prio, err1 := strconv.Atoi(fields[0])
+		nanos, err2 := strconv.ParseInt(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		fn := filepath.Join(qdir, de.Name())
+		if f, err := lockFile(fn, false); err == nil && f != nil {
+			os.Remove(fn)
+			f.Close()
+			continue
+		}
+		entries = append(entries, queueEntry{de.Name(), prio, nanos})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].prio != entries[j].prio {
+			return entries[i].prio > entries[j].prio
+		}
+		return entries[i].nanos < entries[j].nanos
+	})
+	return entries, nil
+}
+
+// trySlots locks n free slots, or none.
+func (s *fileScheduler) trySlots(n int) ([]*os.File, error) {
+	var slots []*os.File
+	for i := 0; i < s.max && len(slots) < n; i++ {
+		f, err := lockFile(filepath.Join(s.dir, fmt.Sprintf("slot.%d.lock", i)), false)
+		if err != nil {
+			closeAll(slots)
+			return nil, err
+		}
+		if f != nil {
+			slots = append(slots, f)
+		}
+	}
+	if len(slots) < n {
+		closeAll(slots)
+		return nil, nil
+	}
+	return slots, nil
+}
+
+func closeAll(fs []*os.File) {
+	for _, f := range fs {
+		f.Close()
+	}
+}
+
+func (s *fileScheduler) acquire(prio, n int) (func(), error) {
+	n = min(n, s.max)
+	qdir := filepath.Join(s.dir, "queue")
+	if err := s.mkdir(qdir); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%d.%d.%d", prio, time.Now().UnixNano(), os.Getpid())
+	qfn := filepath.Join(qdir, name)
+	// The entry is locked before it appears under its name, or
+	// queue would take it for the entry of a dead process.
+	tmp := filepath.Join(qdir, "new."+name)
+	q, err := lockFile(tmp, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, qfn); err != nil {
+		os.Remove(tmp)
+		q.Close()
+		return nil, err
+	}
+	defer func() {
+		os.Remove(qfn)
+		q.Close()
+	}()
+
+	for {
+		entries, err := s.queue(qdir)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 && entries[0].name == name {
+			slots, err := s.trySlots(n)
+			if err != nil {
+				return nil, err
+			}
+			if slots != nil {
+				return func() { closeAll(slots) }, nil
+			}
+		}
+		time.Sleep(s.poll)
+	}
+}
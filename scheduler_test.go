@@ -0,0 +1,158 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testSchedulerOrder checks that waiters get the single slot by
+// priority, and then in order of arrival.
+func testSchedulerOrder(t *testing.T, s scheduler, settle time.Duration) {
+	release, err := s.acquire(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	order := make(chan int)
+	for i, prio := range []int{0, 0, masterPriority} {
+		go func() {
+			release, err := s.acquire(prio, 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			order <- i
+			release()
+		}()
+		// Let the waiter queue up before the next one.
+		time.Sleep(settle)
+	}
+
+	select {
+	case i := <-order:
+		t.Fatalf("waiter %d ran while the slot was taken", i)
+	default:
+	}
+	release()
+
+	var got []int
+	for range 3 {
+		got = append(got, <-order)
+	}
+	if want := []int{2, 0, 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
+
+func TestMemSchedulerOrder(t *testing.T) {
+	testSchedulerOrder(t, newMemScheduler(1), 10*time.Millisecond)
+}
+
+func TestFileSchedulerOrder(t *testing.T) {
+	s := newFileScheduler(t.TempDir(), 1)
+	s.poll = 5 * time.Millisecond
+	testSchedulerOrder(t, s, 50*time.Millisecond)
+}
+
+func TestFileSchedulerSlots(t *testing.T) {
+	s := newFileScheduler(t.TempDir(), 2)
+	s.poll = 5 * time.Millisecond
+
+	// More slots than available are capped at the maximum.
+	release, err := s.acquire(0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slots, err := s.trySlots(1); err != nil || slots != nil {
+		t.Fatalf("got free slots %v (%v) while all are taken", slots, err)
+	}
+	release()
+	slots, err := s.trySlots(2)
+	if err != nil || len(slots) != 2 {
+		t.Fatalf("got %d slots (%v) after release, want 2", len(slots), err)
+	}
+	closeAll(slots)
+}
+
+// TestFileSchedulerQueueRace checks that waiters are not lost while
+// other processes scan the queue for dead entries.
+func TestFileSchedulerQueueRace(t *testing.T) {
+	s := newFileScheduler(t.TempDir(), 1)
+	s.poll = time.Millisecond
+	qdir := filepath.Join(s.dir, "queue")
+	if err := s.mkdir(qdir); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if _, err := s.queue(qdir); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-scanned
+	}()
+
+	const waiters = 50
+	done := make(chan struct{}, waiters)
+	for range waiters {
+		go func() {
+			release, err := s.acquire(0, 1)
+			if err != nil {
+				t.Error(err)
+			} else {
+				release()
+			}
+			done <- struct{}{}
+		}()
+	}
+	timeout := time.After(20 * time.Second)
+	for i := range waiters {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatalf("%d of %d waiters still waiting", waiters-i, waiters)
+		}
+	}
+}
+
+// TestLockFileReadOnly checks that a lock file created by another
+// user, and so not writable, can still be locked.
+func TestLockFileReadOnly(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("root can write any file")
+	}
+	fn := filepath.Join(t.TempDir(), "repo.lock")
+	if err := os.WriteFile(fn, nil, 0444); err != nil {
+		t.Fatal(err)
+	}
+	f, err := lockFile(fn, false)
+	if err != nil || f == nil {
+		t.Fatalf("lockFile: %v, %v", f, err)
+	}
+	f.Close()
+}
+
+func TestRunPriority(t *testing.T) {
+	if got := runPriority("master", 1); got != 1+masterPriority {
+		t.Errorf("master: got %d", got)
+	}
+	if got := runPriority("feature", 1); got != 1 {
+		t.Errorf("feature: got %d", got)
+	}
+}
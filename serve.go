@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	httpAddr = flag.String("http", "localhost:8080", "serve: address to listen on")
+
+	// remoteURLRe matches the repository URLs that can be submitted:
+	// http(s), ssh and git URLs, and scp-like ssh addresses.
+	branchRe    = regexp.MustCompile(`^[a-zA-Z0-9._/+-]+$`)
+	remoteURLRe = regexp.MustCompile(`^((https?|ssh|git)://[^-]|[a-zA-Z0-9_.-]+@[a-zA-Z0-9][a-zA-Z0-9.-]*:)`)
+)
+
+// checkBranch rejects branch names that git does not accept. As the
+// name ends up in paths in shell commands for remote executors, only
+// plain characters are allowed.
+func checkBranch(branch string) error {
+	if strings.HasPrefix(branch, "-") || !branchRe.MatchString(branch) {
+		return fmt.Errorf("invalid branch %q", branch)
+	}
+	out, err := exec.Command("git", "check-ref-format", "--branch", branch).Output()
+	if err != nil || strings.TrimSpace(string(out)) != branch {
+		return fmt.Errorf("invalid branch %q", branch)
+	}
+	return nil
+}
+
+// checkURL rejects repositories other than network URLs and the
+// given remotes of the lilypond checkout.
+func checkURL(url string, remotes []string) error {
+	if remoteURLRe.MatchString(url) || slices.Contains(remotes, url) {
+		return nil
+	}
+	return fmt.Errorf("url %q must be an http(s), ssh or git URL, or one of the remotes %v", url, remotes)
+}
+
+// lilypondRemotes returns the remotes of the lilypond checkout.
+func lilypondRemotes() []string {
+	out, err := exec.Command("git", "-C", "lilypond", "remote").Output()
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// job is a test run submitted to the server.
+type job struct {
+	ID       int
+	Platform string
+	Mode     string
+	Stage    string
+	URL      string
+	Branch   string
+	// Rietveld is a change number to patch in, instead of URL
+	// and Branch.
+	Rietveld int
+	// Rebase overrides the --rebase option.
+	Rebase string
+	// Priority is the scheduling priority, see runPriority.
+	Priority int
+	// Executor is the executor running the job.
+	Executor string
+
+	Submitted time.Time
+	Started   time.Time
+}
+
+// server runs submitted jobs on the executors, one per executor slot.
+type server struct {
+	opts *testOptions
+	// gc, if set, is applied after each job.
+	gc      *gcOptions
+	metrics *metrics
+	pool    *executorPool
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	nextID  int
+	queue   []*job
+	running []*job
+}
+
+func newServer(opts *testOptions, pool *executorPool) *server {
+	s := &server{
+		opts:    opts,
+		metrics: newMetrics(),
+		pool:    pool,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *server) submit(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	j.ID = s.nextID
+	j.Submitted = time.Now()
+	s.queue = append(s.queue, j)
+	s.cond.Signal()
+}
+
+// next waits for a job and marks it running.
+func (s *server) next() *job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) == 0 {
+		s.cond.Wait()
+	}
+	// The queue is in submission order; take the first job of the
+	// highest priority.
+	best := 0
+	for i, j := range s.queue {
+		if j.Priority > s.queue[best].Priority {
+			best = i
+		}
+	}
+	j := s.queue[best]
+	s.queue = append(s.queue[:best], s.queue[best+1:]...)
+	j.Started = time.Now()
+	s.running = append(s.running, j)
+	return j
+}
+
+// runOrder returns the queued jobs in the order next takes them.
+func runOrder(queue []*job) []*job {
+	order := slices.Clone(queue)
+	slices.SortStableFunc(order, func(a, b *job) int { return b.Priority - a.Priority })
+	return order
+}
+
+func (s *server) done(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range s.running {
+		if r == j {
+			s.running = append(s.running[:i], s.running[i+1:]...)
+			break
+		}
+	}
+}
+
+func (s *server) runJob(j *job) error {
+	url, branch := j.URL, j.Branch
+	if j.Rietveld != 0 {
+		unlock, err := sched.lockRepo()
+		if err != nil {
+			return err
+		}
+		branch, err = patchRietveldChange(j.Rietveld)
+		unlock()
+		if err != nil {
+			return err
+		}
+		url = "lilypond"
+	}
+
+	e, err := s.pool.acquire(*executorName, j.Platform)
+	if err != nil {
+		return err
+	}
+	defer s.pool.release(e)
+	opts := *s.opts
+	opts.Executor = e
+	opts.Priority = j.Priority
+	if j.Rebase != "" {
+		opts.Rebase = j.Rebase
+	}
+	s.mu.Lock()
+	j.Executor = e.Name
+	s.mu.Unlock()
+	_, err = testOne(j.Platform, j.Mode, j.Stage, url, branch, &opts)
+	return err
+}
+
+func (s *server) worker() {
+	for {
+		j := s.next()
+		s.metrics.start(j)
+		err := s.runJob(j)
+		status := "ok"
+		var conflict *rebaseConflict
+		if errors.As(err, &conflict) {
+			status = "conflict"
+			log.Printf("job %d: %v", j.ID, err)
+		} else if err != nil {
+			status = "failed"
+			log.Printf("job %d: %v", j.ID, err)
+		}
+		s.metrics.finish(j, status, time.Since(j.Started))
+		s.done(j)
+
+		if s.gc != nil {
+			if err := collectGarbage(s.gc); err != nil {
+				log.Printf("gc: %v", err)
+			}
+		}
+	}
+}
+
+// handleSubmit queues jobs. It takes the form values url and branch,
+// or rietveld, and optionally platform (a comma separated list), mode
+// and stage.
+func (s *server) handleSubmit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "POST only", http.StatusMethodNotAllowed)
+		return
+	}
+	value := func(key, def string) string {
+		if v := req.FormValue(key); v != "" {
+			return v
+		}
+		return def
+	}
+	platforms, err := parsePlatforms(value("platform", "ubuntu18"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tmpl := job{
+		Mode:   value("mode", "incremental"),
+		Stage:  value("stage", "check"),
+		URL:    req.FormValue("url"),
+		Branch: req.FormValue("branch"),
+		Rebase: req.FormValue("rebase"),
+	}
+	prio := *priority
+	if p := req.FormValue("priority"); p != "" {
+		if prio, err = strconv.Atoi(p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	tmpl.Priority = runPriority(tmpl.Branch, prio)
+	if tmpl.Rebase != "" && tmpl.Rebase != "rebase" && tmpl.Rebase != "merge" {
+		http.Error(w, "rebase must be 'rebase' or 'merge'", http.StatusBadRequest)
+		return
+	}
+	if tmpl.Stage, err = checkModeStage(tmpl.Mode, tmpl.Stage); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tmpl.Mode == "release" {
+		platforms = []string{releasePlatform}
+	}
+	if r := req.FormValue("rietveld"); r != "" {
+		if tmpl.Rietveld, err = strconv.Atoi(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if tmpl.URL == "" || tmpl.Branch == "" {
+		http.Error(w, "need url and branch, or rietveld", http.StatusBadRequest)
+		return
+	} else if err := checkURL(tmpl.URL, lilypondRemotes()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err := checkBranch(tmpl.Branch); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	for _, p := range platforms {
+		j := tmpl
+		j.Platform = p
+		s.submit(&j)
+		fmt.Fprintf(w, "queued job %d: %s %s on %s\n", j.ID, j.URL, j.Branch, p)
+	}
+}
+
+// handleQueue shows the running and queued jobs.
+func (s *server) handleQueue(w http.ResponseWriter, req *http.Request) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	est, err := newEstimates(resultsRoot(cwd))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	duration := func(j *job) *durationEstimate { return est.get(j.Platform, j.Mode, j.Stage) }
+	queue := runOrder(s.queue)
+	ends := expectedEnds(s.running, queue, s.pool.slots(), time.Now(), duration)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATE\tSINCE\tETA\tPRIO\tPLATFORM\tMODE\tSTAGE\tEXECUTOR\tCHANGE")
+	row := func(j *job, state string, since time.Time) {
+		change := j.URL + " " + j.Branch
+		if j.Rietveld != 0 {
+			change = fmt.Sprintf("rietveld %d", j.Rietveld)
+		}
+		eta := "?"
+		if end, ok := ends[j]; ok {
+			eta = end.Format("15:04")
+		}
+		if d := duration(j); d != nil && state == "running" && time.Since(j.Started) > d.P95 {
+			eta += " (slow)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%v\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n", j.ID, state,
+			time.Since(since).Round(time.Second), eta, j.Priority, j.Platform, j.Mode, j.Stage, j.Executor, change)
+	}
+	for _, j := range s.running {
+		row(j, "running", j.Started)
+	}
+	for _, j := range queue {
+		row(j, "queued", j.Submitted)
+	}
+	tw.Flush()
+}
+
+// expectedEnds estimates when each job finishes, if the queued jobs,
+// given in runOrder, take the first free slot in turn. A running job is expected to end
+// at its median duration, or now if it is overdue. Jobs without an
+// estimate, and the jobs queued after them, are left out.
+func expectedEnds(running, queue []*job, slots int, now time.Time, duration func(*job) *durationEstimate) map[*job]time.Time {
+	ends := map[*job]time.Time{}
+	// free holds the time at which each slot frees up.
+	var free []time.Time
+	for _, j := range running {
+		d := duration(j)
+		if d == nil {
+			return ends
+		}
+		end := j.Started.Add(d.P50)
+		ends[j] = end
+		free = append(free, maxTime(end, now))
+	}
+	for len(free) < slots {
+		free = append(free, now)
+	}
+	for _, j := range queue {
+		d := duration(j)
+		if d == nil || len(free) == 0 {
+			break
+		}
+		first := 0
+		for i, t := range free {
+			if t.Before(free[first]) {
+				first = i
+			}
+		}
+		free[first] = free[first].Add(d.P50)
+		ends[j] = free[first]
+	}
+	return ends
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+func (s *server) handleMetrics(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	depth := len(s.queue)
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w, depth)
+}
+
+// serveCommand runs test.go as a service: jobs are submitted over
+// HTTP and run in order.
+func serveCommand(args []string, gc *gcOptions) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: serve")
+	}
+	opts, err := flagTestOptions()
+	if err != nil {
+		return err
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	executors, err := loadExecutors(*executorsFile)
+	if err != nil {
+		return err
+	}
+	pool := newExecutorPool(executors)
+	s := newServer(opts, pool)
+	s.gc = gc
+	go s.metrics.watchDisk(resultsRoot(cwd), 10*time.Minute)
+	go s.metrics.watchSeedImages(10 * time.Minute)
+	for range pool.slots() {
+		go s.worker()
+	}
+
+	http.HandleFunc("/submit", s.handleSubmit)
+	http.HandleFunc("/queue", s.handleQueue)
+	http.HandleFunc("/metrics", s.handleMetrics)
+	log.Printf("serving on %s", *httpAddr)
+	return http.ListenAndServe(*httpAddr, nil)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckBranch(t *testing.T) {
+	for _, b := range []string{"master", "dev/hanwen/guile22", "issue123_4"} {
+		if err := checkBranch(b); err != nil {
+			t.Errorf("%q: %v", b, err)
+		}
+	}
+	for _, b := range []string{"x;rm -rf ~", "a;touch$IFS/tmp/x", "a`id`", "-f", "--upload-pack=touch x", "a..b", "@{-1}", ""} {
+		if err := checkBranch(b); err == nil {
+			t.Errorf("%q: want error", b)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	remotes := []string{"origin", "hanwen"}
+	for _, u := range []string{
+		"https://github.com/hanwen/lilypond",
+		"http://git.example.org/lilypond.git",
+		"ssh://git@gitlab.com/lilypond/lilypond.git",
+		"git://git.sv.gnu.org/lilypond.git",
+		"git@gitlab.com:lilypond/lilypond.git",
+		"hanwen",
+	} {
+		if err := checkURL(u, remotes); err != nil {
+			t.Errorf("%q: %v", u, err)
+		}
+	}
+	for _, u := range []string{
+		"/home/me/lilypond",
+		"../lilypond",
+		"lilypond",
+		"file:///etc",
+		"--upload-pack=touch x",
+		"ssh://-oProxyCommand=x/y",
+		"ext::sh -c touch% x",
+	} {
+		if err := checkURL(u, remotes); err == nil {
+			t.Errorf("%q: want error", u)
+		}
+	}
+}
+
+func TestExpectedEnds(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	running := []*job{{Stage: "check", Started: now.Add(-10 * time.Minute)}}
+	queue := []*job{{Stage: "check"}, {Stage: "build"}, {Stage: "unknown"}, {Stage: "check"}}
+	durations := map[string]*durationEstimate{
+		"check": {P50: 30 * time.Minute},
+		"build": {P50: 20 * time.Minute},
+	}
+	duration := func(j *job) *durationEstimate { return durations[j.Stage] }
+
+	// With one slot, every job waits for all jobs before it.
+	ends := expectedEnds(running, queue, 1, now, duration)
+	all := append(append([]*job{}, running...), queue...)
+	for i, want := range []time.Duration{20, 50, 70} {
+		if got := ends[all[i]]; !got.Equal(now.Add(want * time.Minute)) {
+			t.Errorf("job %d: got %v, want now+%dm", i, got.Sub(now), want)
+		}
+	}
+	if _, ok := ends[queue[2]]; ok {
+		t.Errorf("got ETA for job without estimate")
+	}
+	if _, ok := ends[queue[3]]; ok {
+		t.Errorf("got ETA for job behind one without estimate")
+	}
+
+	// With two slots, the first queued job starts now.
+	ends = expectedEnds(running, queue, 2, now, duration)
+	if got, want := ends[queue[0]], now.Add(30*time.Minute); !got.Equal(want) {
+		t.Errorf("2 slots: got %v, want %v", got, want)
+	}
+	if got, want := ends[queue[1]], now.Add(40*time.Minute); !got.Equal(want) {
+		t.Errorf("2 slots: got %v, want %v", got, want)
+	}
+}
+
+func TestExpectedEndsPriority(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	low := &job{ID: 1, Stage: "check"}
+	high := &job{ID: 2, Stage: "check", Priority: masterPriority}
+	low2 := &job{ID: 3, Stage: "check"}
+	queue := runOrder([]*job{low, high, low2})
+	if queue[0] != high || queue[1] != low || queue[2] != low2 {
+		t.Fatalf("got run order %d %d %d, want 2 1 3", queue[0].ID, queue[1].ID, queue[2].ID)
+	}
+
+	duration := func(*job) *durationEstimate { return &durationEstimate{P50: 30 * time.Minute} }
+	ends := expectedEnds(nil, queue, 1, now, duration)
+	for _, tc := range []struct {
+		j    *job
+		want time.Duration
+	}{{high, 30}, {low, 60}, {low2, 90}} {
+		if got := ends[tc.j]; !got.Equal(now.Add(tc.want * time.Minute)) {
+			t.Errorf("job %d: got now+%v, want now+%dm", tc.j.ID, got.Sub(now), tc.want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+#!/bin/bash
+
+# Run one shard of the regression tests, in a container committed
+# after running a driver script with STAGE "prepare". The other
+# shards' tests are removed from the source tree.
+#
+#  shard-check.sh SHARD SHARD-COUNT BUILD-DIRECTORY
+
+set -eu
+
+# phase NAME marks the start of a build phase in the log. test.go uses
+# these to report phases as test cases.
+phase() {
+    echo "@@@ phase $1 $(date +%s)"
+}
+
+shard=$1
+count=$2
+build=$3
+
+trap "find /lilypond/ $build -name '*.fail.log' -exec cp '{}' /output/ ';'" ERR
+
+phase shard-$shard-select
+cd /lilypond/input/regression
+i=0
+for f in $(ls *.ly | sort) ; do
+    if test $((i % count)) -eq $shard ; then
+	echo ${f%.ly} >> /output/shard-files.txt
+    else
+	rm $f
+    fi
+    i=$((i + 1))
+done
+
+export PATH="/usr/lib64/ccache:/usr/lib/ccache/:$PATH"
+N=$(nproc)
+cd $build
+
+phase shard-$shard-check
+time make check -j$N CPU_COUNT=$N USE_EXTRACTPDFMARK=no
+
+cp -a out/test-results/* /output/
+phase done
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Files in a shard's output that are merged rather than linked into
+// the result directory.
+var shardMergedFiles = map[string]bool{
+	logFile:           true,
+	"shard-files.txt": true,
+	"index.txt":       true,
+	"changed.txt":     true,
+	"index.html":      true,
+}
+
+// shardBuildDir returns the directory where the driver script for
+// mode runs make.
+func shardBuildDir(mode string) string {
+	if mode == "separate" {
+		return "/lpbuild"
+	}
+	return "/lilypond"
+}
+
+// runSharded runs the check stage split over p.Shards containers. The
+// driver script runs the "prepare" stage, the container is committed
+// to an image, and shard-check.sh runs a shard of the regression tests
+// in each of p.Shards containers started from that image. runDest is
+// mounted as /output, with the shard outputs in runDest/shard-K; the
+// logs go to dest/shard-K. Use mergeShards to combine the outputs.
+func runSharded(p *runParams, runDest, dest string, logw io.Writer) error {
+	timeout := fmt.Sprintf("%f", p.Timeout.Seconds())
+	commit := strings.TrimSuffix(filepath.Base(dest), ".tmp")
+	name := fmt.Sprintf("lilypond-ci-prepare-%s-%s-%s-%s", p.Platform, p.Mode, commit, p.Start.Format("20060102-150405"))
+
+	prepare := *p
+	prepare.Stage = "prepare"
+	args := append([]string{"run", "--name", name}, p.mounts(runDest)...)
+	args = append(args, p.SeedImage, "timeout", "--signal=KILL", timeout)
+	args = append(args, prepare.scriptArgs()...)
+	cmd := dockerCommand(p.DockerHost, args...)
+	cmd.Stdout = logw
+	cmd.Stderr = logw
+	log.Printf("running: %v", cmd.Args)
+	err := cmd.Run()
+	if err != nil {
+		dockerOn(p.DockerHost, "rm", name)
+		return err
+	}
+	image, err := dockerOn(p.DockerHost, "commit", name)
+	dockerOn(p.DockerHost, "rm", name)
+	if err != nil {
+		return err
+	}
+	defer dockerOn(p.DockerHost, "rmi", image)
+
+	script := filepath.Join(filepath.Dir(p.Script), "shard-check.sh")
+	errs := make([]error, p.Shards)
+	var wg sync.WaitGroup
+	for k := range p.Shards {
+		shard := fmt.Sprintf("shard-%d", k)
+		dir := filepath.Join(dest, shard)
+		if err := os.Mkdir(dir, 0777); err != nil {
+			return err
+		}
+		out, err := os.Create(filepath.Join(dir, logFile))
+		if err != nil {
+			return err
+		}
+		cmd := dockerCommand(p.DockerHost, "run", "--rm=true",
+			"-v", runDest+"/"+shard+":/output", "-v", script+":/shard.sh:ro",
+			image, "timeout", "--signal=KILL", timeout,
+			"/shard.sh", fmt.Sprint(k), fmt.Sprint(p.Shards), shardBuildDir(p.Mode))
+		cmd.Stdout = out
+		cmd.Stderr = out
+		log.Printf("running shard %d: %v", k, cmd.Args)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[k] = cmd.Run()
+			out.Close()
+			log.Printf("shard %d done: %v", k, errs[k])
+		}()
+	}
+	wg.Wait()
+
+	// Append the shard logs, so the log reads like an unsharded run.
+	for k := range p.Shards {
+		f, err := os.Open(filepath.Join(dest, fmt.Sprintf("shard-%d", k), logFile))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(logw, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for k, err := range errs {
+		if err != nil {
+			return fmt.Errorf("shard %d: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// regtestName returns the test name for a file in the test results.
+func regtestName(fn string) string {
+	base := filepath.Base(fn)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// mergeShardChanges combines the changes reported by the shards.
+// Each shard removed the tests of the other shards, which show up as
+// changes; only the changes for tests in the shard's own set are
+// kept.
+func mergeShardChanges(changes [][]regtestChange, tests []map[string]bool) []regtestChange {
+	var merged []regtestChange
+	for k, cs := range changes {
+		for _, c := range cs {
+			if tests[k][regtestName(c.Name)] {
+				merged = append(merged, c)
+			}
+		}
+	}
+	sort.SliceStable(merged, func(i, j int) bool { return merged[i].Distance > merged[j].Distance })
+	return merged
+}
+
+func readLines(fn string) ([]string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if l := strings.TrimSpace(scanner.Text()); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// linkTree hard links the files under src into dst, skipping files
+// that exist already.
+func linkTree(src, dst string, skip map[string]bool) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if skip[rel] {
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		return os.Link(path, target)
+	})
+}
+
+var shardIndexTemplate = template.Must(template.New("shards").Parse(`<html>
+  <title>Regression test results</title>
+  <body>
+    <ul>
+    {{range .}}<li><a href="shard-{{.}}/index.html">shard {{.}}</a></li>
+    {{end}}</ul>
+  </body>
+</html>
+`))
+
+// mergeShards combines the test results of the shard-K directories in
+// dest into dest, to look like the results of an unsharded run.
+func mergeShards(dest string, n int) error {
+	var changes [][]regtestChange
+	var tests []map[string]bool
+	var changedLines []string
+	var shardNums []int
+	for k := range n {
+		dir := filepath.Join(dest, fmt.Sprintf("shard-%d", k))
+		shardNums = append(shardNums, k)
+
+		names, err := readLines(filepath.Join(dir, "shard-files.txt"))
+		if err != nil {
+			return err
+		}
+		set := map[string]bool{}
+		for _, t := range names {
+			set[t] = true
+		}
+		tests = append(tests, set)
+
+		if err := linkTree(dir, dest, shardMergedFiles); err != nil {
+			return err
+		}
+
+		f, err := os.Open(filepath.Join(dir, "index.txt"))
+		if err != nil {
+			return err
+		}
+		cs, err := parseRegtestIndex(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		changes = append(changes, cs)
+
+		lines, err := readLines(filepath.Join(dir, "changed.txt"))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, l := range lines {
+			if set[regtestName(strings.Fields(l)[0])] {
+				changedLines = append(changedLines, l)
+			}
+		}
+	}
+
+	var index strings.Builder
+	for _, c := range mergeShardChanges(changes, tests) {
+		fmt.Fprintf(&index, "%-30f %-20s\n", c.Distance, c.Name)
+	}
+	if err := os.WriteFile(filepath.Join(dest, "index.txt"), []byte(index.String()), 0644); err != nil {
+		return err
+	}
+	changed := strings.Join(changedLines, "\n")
+	if changed != "" {
+		changed += "\n"
+	}
+	if err := os.WriteFile(filepath.Join(dest, "changed.txt"), []byte(changed), 0644); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(dest, "index.html"))
+	if err != nil {
+		return err
+	}
+	if err := shardIndexTemplate.Execute(f, shardNums); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
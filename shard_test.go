@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMergeShards(t *testing.T) {
+	dest := t.TempDir()
+	shardFiles := []map[string]string{
+		{
+			"shard-files.txt": "beams\nslurs\n",
+			"index.txt":       "0.5 beams.ly\n2.0 ties.ly\n",
+			"changed.txt":     "beams.ly\nties.ly\n",
+			"beams.png":       "png",
+		},
+		{
+			"shard-files.txt": "ties\n",
+			"index.txt":       "1.0 ties.ly\n3.0 slurs.ly\n",
+			"ties.png":        "png",
+		},
+	}
+	for k, files := range shardFiles {
+		dir := filepath.Join(dest, "shard-"+string(rune('0'+k)))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := mergeShards(dest, 2); err != nil {
+		t.Fatalf("mergeShards: %v", err)
+	}
+	for name, want := range map[string]string{
+		"index.txt": `1.000000                       ties.ly             
+0.500000                       beams.ly            
+`,
+		"changed.txt": "beams.ly\n",
+		"beams.png":   "png",
+		"ties.png":    "png",
+	} {
+		got, err := os.ReadFile(filepath.Join(dest, name))
+		if err != nil {
+			t.Errorf("ReadFile: %v", err)
+		} else if string(got) != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+#!/bin/bash
+
+# Compile the .ly files in /input with each Linux release tarball in
+# /output/release. This runs in a container without LilyPond's
+# dependencies, to check that the binaries are self-contained.
+#
+#  smoke-release.sh
+
+set -eu
+
+# phase NAME marks the start of a build phase in the log. test.go uses
+# these to report phases as test cases.
+phase() {
+    echo "@@@ phase $1 $(date +%s)"
+}
+
+cd /output/release
+phase smoke-checksums
+sha256sum -c SHA256SUMS
+
+for tarball in /output/release/*linux*.tar.gz ; do
+    name=$(basename $tarball .tar.gz)
+    phase smoke-$name
+    mkdir -p /tmp/$name /output/smoke/$name
+    tar -C /tmp/$name -xzf $tarball
+    lilypond=$(echo /tmp/$name/*/bin/lilypond)
+    $lilypond --version
+    for ly in /input/*.ly ; do
+	$lilypond -o /output/smoke/$name/$(basename $ly .ly) $ly
+    done
+done
+phase done
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// snapshotLabel is set on kept containers and snapshot images. Its
+// value is the result directory of the run.
+const snapshotLabel = "lilypond-ci.result"
+
+// dockerCommand returns a docker command for the daemon at host, or
+// the local daemon if host is empty.
+func dockerCommand(host string, args ...string) *exec.Cmd {
+	if host != "" {
+		args = append([]string{"-H", host}, args...)
+	}
+	return exec.Command("docker", args...)
+}
+
+func docker(args ...string) (string, error) {
+	return dockerOn("", args...)
+}
+
+// dockerOn runs docker against the daemon at host, and returns its
+// output.
+func dockerOn(host string, args ...string) (string, error) {
+	cmd := dockerCommand(host, args...)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %v", args[0], err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// keepContainer disposes of the named container after the run. The
+// container of a successful run is always removed. For failed runs,
+// keep selects between leaving it stopped and committing it to a
+// snapshot image. The outcome is recorded in result. host is the
+// docker daemon that ran the container.
+func keepContainer(host, name, keep string, failed bool, result *runResult) error {
+	if failed && keep == "stop" {
+		result.Container = name
+		log.Printf("kept stopped container %s", name)
+		return nil
+	}
+	if failed && keep == "snapshot" {
+		tag := "lilypond-snapshot:" + strings.TrimPrefix(name, "lilypond-ci-")
+		id, err := dockerOn(host, "commit", name, tag)
+		if err != nil {
+			return err
+		}
+		result.Snapshot = id
+		log.Printf("committed container %s to %s (%s)", name, tag, id)
+	}
+
+	_, err := dockerOn(host, "rm", name)
+	return err
+}
+
+// snapshotsCommand lists or removes the containers and images kept
+// from failed runs.
+//
+//	snapshots [list]
+//	snapshots rm ID...
+//	snapshots prune [AGE]
+//
+// prune removes all stopped containers and snapshot images, or those
+// older than AGE (e.g. "72h") if given.
+func snapshotsCommand(args []string) error {
+	filter := "label=" + snapshotLabel
+	sub := "list"
+	if len(args) > 0 {
+		sub = args[0]
+		args = args[1:]
+	}
+
+	switch sub {
+	case "list":
+		containers, err := docker("ps", "-a", "--filter", filter,
+			"--format", `{{.ID}}	{{.Names}}	{{.Status}}	{{.Label "`+snapshotLabel+`"}}`)
+		if err != nil {
+			return err
+		}
+		images, err := docker("images", "--filter", filter,
+			"--format", `{{.ID}}	{{.Repository}}:{{.Tag}}	{{.CreatedSince}}	{{.Size}}`)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("containers:\n%s\n\nimages:\n%s\n", containers, images)
+	case "rm":
+		for _, id := range args {
+			if _, err := docker("rm", id); err == nil {
+				continue
+			}
+			if _, err := docker("rmi", id); err != nil {
+				return err
+			}
+		}
+	case "prune":
+		filters := []string{"--filter", filter}
+		if len(args) > 0 {
+			filters = append(filters, "--filter", "until="+args[0])
+		}
+		out, err := docker(append([]string{"container", "prune", "-f"}, filters...)...)
+		if err != nil {
+			return err
+		}
+		fmt.Println(out)
+		out, err = docker(append([]string{"image", "prune", "-a", "-f"}, filters...)...)
+		if err != nil {
+			return err
+		}
+		fmt.Println(out)
+	default:
+		return fmt.Errorf("unknown snapshots command %q", sub)
+	}
+	return nil
+}
@@ -4,12 +4,22 @@
 # the tests, make doc.
 #
 #  test.sh STAGE GIT-URL REMOTE-BRANCH  LOCAL-GIT-DIRECTORY LOCAL-BASELINE
+#
+# STAGE "prepare" stops before "make check", leaving a tree for
+# shard-check.sh.
 
 stage=$1
 shift
 
 set -eu
 
+# phase NAME marks the start of a build phase in the log. test.go uses
+# these to report phases as test cases.
+phase() {
+    echo "@@@ phase $1 $(date +%s)"
+}
+
+phase checkout
 mkdir /lilypond
 cd /lilypond
 cp -a $3/.git .
@@ -22,27 +32,34 @@ N=$(nproc)
 export PATH="/usr/lib64/ccache:/usr/lib/ccache/:$PATH"
 
 case "${stage}" in
-    doc|check)
+    doc|check|prepare)
+	phase build-baseline
 	time make -j$N
+	phase test-baseline
 	time make test-baseline -j$N CPU_COUNT=$N
 	make distclean
 	;;
 esac
 
+phase build
 git fetch $1 $2:test
 git checkout test
 ./autogen.sh
 time make -j$N
 
 case "${stage}" in
-build)
+build|prepare)
+    phase done
     exit 0
     ;;
 doc)
+    phase doc
     time make doc -j$N CPU_COUNT=$N USE_EXTRACTPDFMARK=no
+    cp -a out-www/offline-root /output/doc
     ;;
 esac
 
+phase check
 time make check -j$N CPU_COUNT=$N USE_EXTRACTPDFMARK=no
 
 echo ''
@@ -51,3 +68,4 @@ echo ''
 cat out/test-results/index.txt
 
 cp -a out/test-results/* /output/
+phase done
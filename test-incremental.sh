@@ -4,30 +4,45 @@
 # usage. Should run inside the container.
 #
 #  test.sh STAGE GIT-URL REMOTE-BRANCH
+#
+# STAGE "prepare" stops before "make check", leaving a tree for
+# shard-check.sh.
 
 stage=$1
 shift
 
 set -eu
+
+# phase NAME marks the start of a build phase in the log. test.go uses
+# these to report phases as test cases.
+phase() {
+    echo "@@@ phase $1 $(date +%s)"
+}
+
 cd /lilypond
 export PATH="/usr/lib64/ccache:/usr/lib/ccache/:$PATH"
 
+phase checkout
 git fetch $1 $2
 git checkout FETCH_HEAD
 
 trap "find /lilypond/ -name '*.fail.log' -exec cp '{}' /output/ ';'" ERR
 
 N=$(nproc)
+phase build
 ./autogen.sh --enable-gs-api
 time make -j$N
 ccache -s
 
+phase install
 make VERBOSE=1 DESTDIR=/tmp/lp install
 
-if test "${stage}" = build ; then
+if test "${stage}" = build || test "${stage}" = prepare ; then
+    phase done
     exit 0
 fi
 
+phase check
 time make check -j$N CPU_COUNT=$N USE_EXTRACTPDFMARK=no
 
 echo ''
@@ -43,7 +58,11 @@ cat out/test-results/changed.txt
 cp -a out/test-results/* /output/
 
 if test "${stage}" != doc ; then
+    phase done
     exit 0
 fi
 
+phase doc
 time make doc -j$N CPU_COUNT=$N
+cp -a out-www/offline-root /output/doc
+phase done
@@ -0,0 +1,41 @@
+#!/bin/bash
+
+# checkout a revision, build the release binaries and collect them
+# with their checksums in /output/release.
+#
+#  test.sh STAGE GIT-URL REMOTE-BRANCH  LOCAL-GIT-DIRECTORY LOCAL-BASELINE
+
+stage=$1
+shift
+
+set -eu
+
+# phase NAME marks the start of a build phase in the log. test.go uses
+# these to report phases as test cases.
+phase() {
+    echo "@@@ phase $1 $(date +%s)"
+}
+
+phase checkout
+mkdir /lilypond
+cd /lilypond
+cp -a $3/.git .
+git fetch $1 $2:test
+git checkout -f test
+
+export PATH="/usr/lib64/ccache:/usr/lib/ccache/:$PATH"
+cd release/binaries
+
+phase binaries-linux
+time python3 run.py
+
+phase binaries-mingw
+time python3 run.py --mingw
+
+phase collect
+mkdir -p /output/release
+cp dist/* /output/release/
+cd /output/release
+sha256sum * > SHA256SUMS
+cat SHA256SUMS
+phase done
@@ -19,21 +19,16 @@ import (
 
 var (
 	allPlatforms = []string{"ubuntu16", "ubuntu18", "fedora31", "fedora31-guile2", "fedora33"}
-	allModes     = []string{"incremental", "full", "separate"}
+	allModes     = []string{"incremental", "full", "separate", "release"}
 	allStages    = []string{"build", "check", "doc"}
-	dockerFiles  = map[string]string{
-		"ubuntu16":        "ubuntu-xenial.dockerfile",
-		"ubuntu18":        "ubuntu-beaver.dockerfile",
-		"fedora31":        "fedora-31.dockerfile",
-		"fedora33":        "fedora-33.dockerfile",
-		"fedora31-guile2": "fedora-31-guile2.dockerfile",
-	}
 )
 
-type platformSetting struct {
-	Tag        string
-	Dockerfile string
-}
+// Paths of the lilypond checkout and the repository to test, as seen
+// from inside the container.
+const (
+	localRepo    = "/local"
+	containerURL = "/local"
+)
 
 func known(ss []string, s string) bool {
 	return slices.Contains(ss, s)
@@ -41,6 +36,7 @@ func known(ss []string, s string) bool {
 
 type rietveldData struct {
 	Patchsets []int `json:"patchsets"`
+	Closed    bool  `json:"closed"`
 }
 
 func system(cmd string) error {
@@ -89,37 +85,220 @@ git commit -m "${ISSUE}" -a`, issue)); err != nil {
 	return issue, nil
 }
 
-func testOne(platform, mode, stage, url, branch string, timeout time.Duration) (string, error) {
+// runParams describes a single test run. It is stored as params.json
+// in the result directory, so the run can be reproduced later.
+type runParams struct {
+	Platform  string        `json:"platform"`
+	Mode      string        `json:"mode"`
+	Stage     string        `json:"stage"`
+	URL       string        `json:"url"`
+	Branch    string        `json:"branch"`
+	Commit    string        `json:"commit"`
+	Baseline  string        `json:"baseline"`
+	SeedImage string        `json:"seed_image"`
+	Repo      string        `json:"repo"`
+	Script    string        `json:"script"`
+	Timeout   time.Duration `json:"timeout"`
+	Start     time.Time     `json:"start"`
+
+	// Rebase is "rebase" or "merge" if the branch was tested on
+	// top of Baseline. EffectiveCommit is the tested commit, held
+	// by EffectiveBranch in Repo.
+	Rebase          string `json:"rebase,omitempty"`
+	EffectiveCommit string `json:"effective_commit,omitempty"`
+	EffectiveBranch string `json:"effective_branch,omitempty"`
+
+	// Shards is the number of containers the regression tests
+	// were split over, if more than one.
+	Shards int `json:"shards,omitempty"`
+
+	// Executor is the name of the executor that ran the test.
+	// For remote executors, DockerHost is the docker daemon, and
+	// Repo, Script and Output are paths on that host.
+	Executor   string `json:"executor,omitempty"`
+	DockerHost string `json:"docker_host,omitempty"`
+	// Output is mounted as /output, if different from the result
+	// directory.
+	Output string `json:"output,omitempty"`
+	// RunRepo is the copy of Repo mounted during the run, see
+	// copyRepo. It is removed afterwards.
+	RunRepo string `json:"run_repo,omitempty"`
+}
+
+const paramsFile = "params.json"
+
+// runResult records the outcome of a test run. It is stored as
+// result.json next to params.json.
+type runResult struct {
+	Status string    `json:"status"`
+	Error  string    `json:"error,omitempty"`
+	End    time.Time `json:"end"`
+
+	// Container is the name of the container, if it was kept.
+	Container string `json:"container,omitempty"`
+	// Snapshot is the image ID of the committed container.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// Suspicious is set if the run took longer than the p95 of
+	// earlier runs of the same platform, mode and stage.
+	Suspicious bool `json:"suspicious,omitempty"`
+}
+
+const resultFile = "result.json"
+
+// testOptions are settings for testOne that are not part of the test
+// matrix.
+type testOptions struct {
+	Timeout time.Duration
+
+	// KeepFailed says what to do with the container of a failed
+	// run: "" removes it, "stop" leaves it stopped and "snapshot"
+	// commits it to an image.
+	KeepFailed string
+
+	// Shards splits the regression tests of the check stage over
+	// this many containers.
+	Shards int
+
+	// Rebase is "rebase" or "merge" to test the branch on top of
+	// origin/master, rather than as is.
+	Rebase string
+
+	// Priority orders runs waiting for a container slot. Higher
+	// runs first.
+	Priority int
+
+	// Executor runs the containers. If nil, they run locally.
+	Executor *executor
+}
+
+// mounts returns the docker options for the bind mounts of the run,
+// with dest mounted as /output.
+func (p *runParams) mounts(dest string) []string {
+	repo := p.Repo
+	if p.RunRepo != "" {
+		repo = p.RunRepo
+	}
+	return []string{
+		"-v", dest + ":/output",
+		"-v", repo + ":" + localRepo + ":ro",
+		"-v", p.Script + ":/test.sh:ro",
+	}
+}
+
+// testedBranch returns the branch in Repo holding the tested commit.
+func (p *runParams) testedBranch() string {
+	if p.EffectiveBranch != "" {
+		return p.EffectiveBranch
+	}
+	return p.Branch
+}
+
+// testedCommit returns the commit that was tested.
+func (p *runParams) testedCommit() string {
+	if p.EffectiveCommit != "" {
+		return p.EffectiveCommit
+	}
+	return p.Commit
+}
+
+// scriptArgs returns the command line for the driver script.
+func (p *runParams) scriptArgs() []string {
+	return []string{"/test.sh", p.Stage, containerURL, p.testedBranch(), localRepo, p.Baseline}
+}
+
+func writeJSON(fn string, v any) error {
+	data, err := json.MarshalIndent(v, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fn, data, 0644)
+}
+
+func readJSON(fn string, v any) error {
+	data, err := os.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// resultsRoot returns the directory holding all test results, for the
+// CI directory cwd.
+func resultsRoot(cwd string) string {
+	return filepath.Join(filepath.Dir(cwd), "lilypond-test-results")
+}
+
+func gitRevParse(args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"--git-dir", "lilypond/.git/", "rev-parse"}, args...)...)
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("rev-parse %v: %v", args, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func testOne(platform, mode, stage, url, branch string, opts *testOptions) (string, error) {
 	driverScript := fmt.Sprintf("test-%s.sh", mode)
 	seedImage := "lilypond-base-" + platform
 	if mode == "incremental" {
 		seedImage = "lilypond-seed-" + platform
 	}
 
-	localRepo := "/local"
 	log.Println("***")
 	log.Printf("Testing %s %s for %s mode %s stage %s", url, branch, platform, mode, stage)
 	log.Println("***")
 
-	containerURL := "/local"
+	if err := checkBranch(branch); err != nil {
+		return "", err
+	}
+	unlockRepo, err := sched.lockRepo()
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if unlockRepo != nil {
+			unlockRepo()
+		}
+	}()
 	if fi, err := os.Stat(url); err == nil && fi.IsDir() && url != "lilypond" {
 		url, err = filepath.Abs(url)
 		if err != nil {
 			return "", err
 		}
-		if err := system(fmt.Sprintf(`cd lilypond &&
-git checkout -f $(git rev-parse origin/master) &&
-git fetch -f %s %s:%s`, url, branch, branch)); err != nil {
+		master, err := gitRevParse("origin/master")
+		if err != nil {
 			return "", err
 		}
+		for _, args := range [][]string{
+			{"checkout", "-f", master},
+			{"fetch", "-f", "--", url, branch + ":" + branch},
+		} {
+			if _, err := gitIn("lilypond", args...); err != nil {
+				return "", err
+			}
+		}
 	}
 
-	cmd := exec.Command("git", "--git-dir", "lilypond/.git/", "rev-parse", "--short=8", branch)
-	shortHashBytes, err := cmd.Output()
+	shortHash, err := gitRevParse("--short=8", branch)
+	if err != nil {
+		return "", err
+	}
+	commit, err := gitRevParse(branch)
+	if err != nil {
+		return "", err
+	}
+	if opts.Rebase != "" {
+		// Test against the latest master, not whatever the
+		// checkout last fetched.
+		if _, err := gitIn("lilypond", "fetch", "origin", "+refs/heads/master:refs/remotes/origin/master"); err != nil {
+			return "", fmt.Errorf("fetching origin/master: %v", err)
+		}
+	}
+	baseline, err := gitRevParse("origin/master")
 	if err != nil {
 		return "", err
 	}
-	shortHash := strings.TrimSpace(string(shortHashBytes))
 
 	name := regexp.MustCompile("^.*:").ReplaceAllString(url+"_"+branch, "")
 	name = regexp.MustCompile("[:/ ]").ReplaceAllString(name, "-")
@@ -127,9 +306,14 @@ git fetch -f %s %s:%s`, url, branch, branch)); err != nil {
 	if err != nil {
 		return "", err
 	}
-	finalDest := filepath.Join(cwd, "../lilypond-test-results", name, stage, seedImage, shortHash)
+	// A rebased run depends on both the branch and master.
+	dirHash := shortHash
+	if opts.Rebase != "" {
+		dirHash = fmt.Sprintf("%s-on-%.8s", shortHash, baseline)
+	}
+	finalDest := filepath.Join(resultsRoot(cwd), name, stage, seedImage, dirHash)
 	if fi, err := os.Lstat(finalDest); err == nil && fi.IsDir() {
-		log.Printf("already ran tests on %s, or remove %s", shortHash, finalDest)
+		log.Printf("already ran tests on %s, or remove %s", dirHash, finalDest)
 		return finalDest, nil
 	}
 
@@ -142,35 +326,119 @@ git fetch -f %s %s:%s`, url, branch, branch)); err != nil {
 		return "", err
 	}
 
+	timeout := opts.Timeout
 	if timeout == 0 {
 		timeout = 24 * 60 * 60 * time.Second
 	}
 
-	cmd = exec.Command("docker",
-		"run", "-v", dest+":/output", "-v", filepath.Join(cwd, "lilypond")+":/"+localRepo+":ro",
-		"-v", filepath.Join(cwd, driverScript)+":/test.sh:ro", "--rm=true",
-		seedImage, "timeout", "--signal=KILL", fmt.Sprintf("%f", timeout.Seconds()), "/test.sh", stage, containerURL, branch, localRepo, "origin/master")
+	params := runParams{
+		Platform:  platform,
+		Mode:      mode,
+		Stage:     stage,
+		URL:       url,
+		Branch:    branch,
+		Commit:    commit,
+		Baseline:  baseline,
+		SeedImage: seedImage,
+		Repo:      filepath.Join(cwd, "lilypond"),
+		Script:    filepath.Join(cwd, driverScript),
+		Timeout:   timeout,
+		Start:     time.Now(),
+	}
+	if stage == "check" && opts.Shards > 1 {
+		params.Shards = opts.Shards
+	}
+	var runErr error
+	if opts.Rebase != "" {
+		params.Rebase = opts.Rebase
+		params.EffectiveBranch = rebasedBranchPrefix + dirHash
+		params.EffectiveCommit, runErr = ontoMaster("lilypond", opts.Rebase, commit, baseline, params.EffectiveBranch)
+		if runErr != nil {
+			params.EffectiveBranch = ""
+		}
+	}
+	runDest := dest
+	if e := opts.Executor; e != nil {
+		params.Executor = e.Name
+		if e.Host != "" {
+			rel, err := filepath.Rel(resultsRoot(cwd), dest)
+			if err != nil {
+				return "", err
+			}
+			params.DockerHost = e.dockerHost()
+			params.Repo = e.Dir + "/lilypond"
+			params.Script = e.Dir + "/" + driverScript
+			params.Output = e.Dir + "/results/" + rel
+			runDest = params.Output
+			if runErr == nil {
+				if err := e.sync(); err != nil {
+					return "", err
+				}
+			}
+		}
+	}
+	if runErr == nil {
+		// The containers read the repository long after they
+		// start, while later runs update it, so each run gets
+		// its own copy.
+		host, repos := "", filepath.Join(cwd, jobReposDir)
+		if e := opts.Executor; e != nil && e.Host != "" {
+			host, repos = e.Host, e.Dir+"/"+jobReposDir
+		}
+		params.RunRepo = fmt.Sprintf("%s/%d-%d", repos, os.Getpid(), time.Now().UnixNano())
+		if err := copyRepo(host, params.Repo, params.RunRepo); err != nil {
+			return "", err
+		}
+		defer func() {
+			if err := removeRepo(host, params.RunRepo); err != nil {
+				log.Printf("removeRepo: %v", err)
+			}
+		}()
+	}
+	// Write the parameters before waiting, so gc sees the run, and
+	// keeps its rebased branch.
+	if err := writeJSON(filepath.Join(dest, paramsFile), &params); err != nil {
+		return "", err
+	}
+	indexRun(resultsRoot(cwd), dest)
+	unlockRepo()
+	unlockRepo = nil
+
+	// Remote executors limit their own jobs.
+	release := func() {}
+	defer func() { release() }()
+	if runErr == nil && params.DockerHost == "" {
+		log.Printf("waiting for a container slot")
+		if release, err = sched.acquire(opts.Priority, max(params.Shards, 1)); err != nil {
+			return "", err
+		}
+		params.Start = time.Now()
+		if err := writeJSON(filepath.Join(dest, paramsFile), &params); err != nil {
+			return "", err
+		}
+	}
+
 	r, w, err := os.Pipe()
 	if err != nil {
 		return "", err
 	}
-	cmd.Stdout = w
-	cmd.Stderr = w
 	defer w.Close()
 	defer r.Close()
 
 	// closing?
-	logFilename := filepath.Join(dest, "log.txt")
+	logFilename := filepath.Join(dest, logFile)
 	log.Printf("logfile in %s", logFilename)
-	logFile, err := os.Create(logFilename)
+	logOut, err := os.Create(logFilename)
 	if err != nil {
 		return "", err
 	}
+	logDone := make(chan struct{})
 	go func() {
+		defer close(logDone)
 		buf := make([]byte, 4096)
 		for {
 			n, err := r.Read(buf)
-			_, err2 := logFile.Write(buf[:n])
+			_, err2 := logOut.Write(buf[:n])
 			os.Stdout.Write(buf[:n])
 			if err2 != nil {
 				log.Printf("log write: %v", err)
@@ -180,19 +448,100 @@ git fetch -f %s %s:%s`, url, branch, branch)); err != nil {
 				break
 			}
 		}
-		logFile.Close()
+		logOut.Close()
 	}()
 
-	log.Printf("running: %v", cmd.Args)
-	if err := cmd.Run(); err != nil {
+	var estimate *durationEstimate
+	stopWatch := func() {}
+	if est, err := newEstimates(resultsRoot(cwd)); err != nil {
+		log.Printf("estimate: %v", err)
+	} else if estimate = est.get(platform, mode, stage); estimate != nil && runErr == nil {
+		stopWatch = watchDuration(estimate, params.Start, w)
+	}
+
+	container := ""
+	if runErr != nil {
+		fmt.Fprintln(w, runErr)
+	} else if params.Shards > 1 {
+		runErr = runSharded(&params, runDest, dest, w)
+	} else {
+		args := append([]string{"run"}, params.mounts(runDest)...)
+		if opts.KeepFailed != "" {
+			container = fmt.Sprintf("lilypond-ci-%s-%s-%s-%s-%s", platform, mode, stage, shortHash, params.Start.Format("20060102-150405"))
+			// Only failed runs keep their container, and those
+			// stay in dest.
+			args = append(args, "--name", container, "--label", snapshotLabel+"="+dest)
+		} else {
+			args = append(args, "--rm=true")
+		}
+		args = append(args, seedImage, "timeout", "--signal=KILL", fmt.Sprintf("%f", timeout.Seconds()))
+		args = append(args, params.scriptArgs()...)
+		cmd := dockerCommand(params.DockerHost, args...)
+		cmd.Stdout = w
+		cmd.Stderr = w
+
+		log.Printf("running: %v", cmd.Args)
+		runErr = cmd.Run()
+	}
+	if runErr == nil && mode == "release" {
+		runErr = smokeTestRelease(&params, runDest, w)
+	}
+	stopWatch()
+	w.Close()
+	<-logDone
+	release()
+	release = func() {}
+	if runDest != dest {
+		if err := opts.Executor.fetchResults(runDest, dest); err != nil {
+			log.Printf("fetchResults: %v", err)
+			if runErr == nil {
+				runErr = err
+			}
+		}
+	}
+	if runErr == nil && params.Shards > 1 {
+		runErr = mergeShards(dest, params.Shards)
+	}
+	if runErr == nil && stage == "doc" {
+		diffMasterDoc(resultsRoot(cwd), dest, platform)
+	}
+	result := runResult{
+		Status: "ok",
+		End:    time.Now(),
+	}
+	if estimate != nil && result.End.Sub(params.Start) > estimate.P95 {
+		result.Suspicious = true
+	}
+	var conflict *rebaseConflict
+	if errors.As(runErr, &conflict) {
+		result.Status = "conflict"
+		result.Error = runErr.Error()
+	} else if runErr != nil {
+		result.Status = "failed"
+		result.Error = runErr.Error()
+	}
+	if container != "" {
+		if err := keepContainer(params.DockerHost, container, opts.KeepFailed, runErr != nil, &result); err != nil {
+			log.Printf("keepContainer: %v", err)
+		}
+	}
+	if err := writeJSON(filepath.Join(dest, resultFile), &result); err != nil {
 		return "", err
 	}
+	if err := writeJUnit(dest); err != nil {
+		log.Printf("writeJUnit: %v", err)
+	}
+	if runErr != nil {
+		indexRun(resultsRoot(cwd), dest)
+		return "", runErr
+	}
 	if err := os.Rename(dest, finalDest); err != nil {
 		return "", err
 	}
+	indexRun(resultsRoot(cwd), finalDest)
 
 	os.Remove(filepath.Join(filepath.Dir(finalDest), "latest"))
-	if err := os.Symlink(shortHash, filepath.Join(filepath.Dir(finalDest), "latest")); err != nil {
+	if err := os.Symlink(dirHash, filepath.Join(filepath.Dir(finalDest), "latest")); err != nil {
 		log.Printf("Symlink: %v", err)
 	}
 	log.Printf("results in %s", finalDest)
@@ -200,31 +549,127 @@ git fetch -f %s %s:%s`, url, branch, branch)); err != nil {
 	return finalDest, nil
 }
 
-func main() {
-	platform := flag.String("platform", "ubuntu18", "platform to test on: "+strings.Join(allPlatforms, " "))
-	mode := flag.String("mode", "incremental", "how to build: "+strings.Join(allModes, " "))
-	stage := flag.String("stage", "check", "which stage to execute: "+strings.Join(allStages, " "))
-	doTest := flag.Bool("test", true, "test a change")
-	doRebase := flag.Bool("rebase", false, "recreate base image")
-	doReseed := flag.Bool("reseed", false, "recreate seed image")
-	rietveld := flag.Int("rietveld", 0, "rietveld change number")
-	timeout := flag.Duration("timeout", 0, "timeout for the subprocess")
-	flag.Parse()
+var (
+	timeout    = flag.Duration("timeout", 0, "timeout for the subprocess")
+	keepFailed = flag.String("keep_failed", "", "keep the container of a failed run: 'stop' leaves it stopped, 'snapshot' commits it to an image")
+	shards     = flag.Int("shards", 1, "split make check over this many containers")
+	rebaseOnto = flag.String("rebase", "", "test the branch rebased ('rebase') or merged ('merge') onto origin/master, rather than as is")
+)
 
+// flagTestOptions returns the test options given on the command line.
+func flagTestOptions() (*testOptions, error) {
+	if *keepFailed != "" && *keepFailed != "stop" && *keepFailed != "snapshot" {
+		return nil, fmt.Errorf("unknown --keep_failed value %q", *keepFailed)
+	}
+	if *keepFailed != "" && *shards > 1 {
+		return nil, fmt.Errorf("--keep_failed does not work with --shards")
+	}
+	if *rebaseOnto != "" && *rebaseOnto != "rebase" && *rebaseOnto != "merge" {
+		return nil, fmt.Errorf("unknown --rebase value %q", *rebaseOnto)
+	}
+	return &testOptions{
+		Timeout:    *timeout,
+		KeepFailed: *keepFailed,
+		Shards:     *shards,
+		Rebase:     *rebaseOnto,
+		Priority:   *priority,
+	}, nil
+}
+
+// knownPlatform reports whether p is a test platform, or the release
+// build platform.
+func knownPlatform(p string) bool {
+	return known(allPlatforms, p) || p == releasePlatform
+}
+
+// checkModeStage validates mode and stage, and returns the stage to
+// run. The release mode has a single stage, "release".
+func checkModeStage(mode, stage string) (string, error) {
+	if !known(allModes, mode) {
+		return "", fmt.Errorf("unknown mode %q", mode)
+	}
+	if mode == "release" {
+		return "release", nil
+	}
+	if !known(allStages, stage) {
+		return "", fmt.Errorf("unknown stage %q", stage)
+	}
+	return stage, nil
+}
+
+// parsePlatforms parses a comma separated list of platforms, where
+// "all" selects all platforms.
+func parsePlatforms(s string) ([]string, error) {
 	var platforms []string
-	for p := range strings.SplitSeq(*platform, ",") {
+	for p := range strings.SplitSeq(s, ",") {
 		if p == "all" {
-			platforms = allPlatforms
-			break
+			return allPlatforms, nil
 		}
 		if p == "guile2" {
 			p = "fedora-guile2"
 		}
-		if !known(allPlatforms, p) {
-			log.Fatalf("unknown platform %q", *platform)
+		if !knownPlatform(p) {
+			return nil, fmt.Errorf("unknown platform %q", s)
 		}
 		platforms = append(platforms, p)
 	}
+	return platforms, nil
+}
+
+// subcommands returns the subcommands, selected by the first
+// positional argument. Flags must precede the subcommand. gc is the
+// garbage collection policy, and afterRun is set if it applies after
+// each test run.
+func subcommands(gc *gcOptions, afterRun bool) map[string]func(args []string) error {
+	serveGC := gc
+	if !afterRun {
+		serveGC = nil
+	}
+	return map[string]func(args []string) error{
+		"repro":         reproCommand,
+		"snapshots":     snapshotsCommand,
+		"export-images": exportImagesCommand,
+		"import-images": importImagesCommand,
+		"generate":      generateCommand,
+		"gc":            func(args []string) error { return gcCommand(args, gc) },
+		"reindex":       reindexCommand,
+		"history":       historyCommand,
+		"status":        statusCommand,
+		"junit":         junitCommand,
+		"serve":         func(args []string) error { return serveCommand(args, serveGC) },
+		"docdiff":       docDiffCommand,
+	}
+}
+
+func main() {
+	platform := flag.String("platform", "ubuntu18", "platform to test on: "+strings.Join(allPlatforms, " "))
+	mode := flag.String("mode", "incremental", "how to build: "+strings.Join(allModes, " ")+". The release mode builds and smoke tests the release binaries")
+	stage := flag.String("stage", "check", "which stage to execute: "+strings.Join(allStages, " "))
+	doTest := flag.Bool("test", true, "test a change")
+	doRebuildBase := flag.Bool("rebuild_base", false, "recreate base image")
+	doReseed := flag.Bool("reseed", false, "recreate seed image")
+	rietveld := flag.Int("rietveld", 0, "rietveld change number")
+	gcAfterRun := flag.Bool("gc", false, "collect garbage in the results directory after each run")
+	var gc gcOptions
+	gc.register(flag.CommandLine)
+	flag.Parse()
+
+	if flag.Arg(0) == "serve" {
+		sched = newMemScheduler(*maxContainers)
+	} else {
+		sched = newFileScheduler(*lockDir, *maxContainers)
+	}
+	if cmd, ok := subcommands(&gc, *gcAfterRun)[flag.Arg(0)]; ok {
+		if err := cmd(flag.Args()[1:]); err != nil {
+			log.Fatalf("%s: %v", flag.Arg(0), err)
+		}
+		return
+	}
+
+	platforms, err := parsePlatforms(*platform)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	if *doReseed {
 		// todo - check if base image exists.
@@ -232,42 +677,69 @@ func main() {
 			if err := system(fmt.Sprintf(`
 		(cd lilypond && git fetch)
 		docker tag lilypond-base-%s lilypond-base
-		docker build -t lilypond-seed-%s -f lilypond-seed.dockerfile .
-`, p, p)); err != nil {
+		docker build -t lilypond-seed-%s %s -f lilypond-seed.dockerfile .
+`, p, p, imageLabels(p, "seed"))); err != nil {
 				log.Fatalf("system (reseed %s): %v", p, err)
 			}
 		}
-	} else if *doRebase {
+	} else if *doRebuildBase {
 		for _, p := range platforms {
-			if err := system(fmt.Sprintf("docker build --no-cache -t lilypond-base-%s -f %s .", p, dockerFiles[p])); err != nil {
-				log.Fatalf("system (rebase %s): %v", p, err)
+			if err := system(fmt.Sprintf("docker build --no-cache -t lilypond-base-%s %s -f %s .", p, imageLabels(p, "base"), platformSettings[p].Dockerfile)); err != nil {
+				log.Fatalf("system (rebuild_base %s): %v", p, err)
 			}
 		}
 	} else if *doTest {
-		if !known(allModes, *mode) {
-			log.Fatalf("unknown mode %q", *mode)
+		if *stage, err = checkModeStage(*mode, *stage); err != nil {
+			log.Fatal(err)
 		}
-		if !known(allStages, *stage) {
-			log.Fatalf("unknown stage %q", *stage)
+		if *mode == "release" {
+			platforms = []string{releasePlatform}
 		}
 
+		opts, err := flagTestOptions()
+		if err != nil {
+			log.Fatal(err)
+		}
 		if *rietveld == 0 && len(flag.Args()) != 2 {
 			log.Fatal("Need URL BRANCH or 'rietveld' CHANGE-NUM")
 		}
 		repoURL := flag.Arg(0)
 		branch := flag.Arg(1)
 		if *rietveld != 0 {
-			var err error
+			unlock, err := sched.lockRepo()
+			if err != nil {
+				log.Fatal(err)
+			}
 			branch, err = patchRietveldChange(*rietveld)
+			unlock()
 			if err != nil {
 				log.Fatalf("patchRietveldChange: %v", err)
 			}
 			repoURL = "lilypond"
 		}
 
+		executors, err := loadExecutors(*executorsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		pool := newExecutorPool(executors)
+
 		var success []string
 		for _, p := range platforms {
-			_, err := testOne(p, *mode, *stage, repoURL, branch, *timeout)
+			e, err := pool.acquire(*executorName, p)
+			if err != nil {
+				log.Fatal(err)
+			}
+			runOpts := *opts
+			runOpts.Executor = e
+			runOpts.Priority = runPriority(branch, opts.Priority)
+			_, err = testOne(p, *mode, *stage, repoURL, branch, &runOpts)
+			pool.release(e)
+			if *gcAfterRun {
+				if err := collectGarbage(&gc); err != nil {
+					log.Printf("gc: %v", err)
+				}
+			}
 			if err != nil {
 				if len(success) > 0 {
 					log.Printf("testOne succeeded on: %s", success)
@@ -277,6 +749,6 @@ func main() {
 			success = append(success, p)
 		}
 	} else {
-		log.Fatal("must specify --test, --rebase or --reseed")
+		log.Fatal("must specify --test, --rebuild_base or --reseed")
 	}
 }